@@ -18,9 +18,11 @@
 package auth
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	prol "github.com/prometheus/common/log"
 )
@@ -32,6 +34,14 @@ type Token struct {
 	authTokenFile string
 }
 
+// CachedToken is an auth token saved with its metadata.
+type CachedToken struct {
+	Token     string    `json:"token"`
+	FetchedAt time.Time `json:"fetched_at"`
+	// ExpiresAt is zero if the expiry of the token is unknown.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
 // NewToken returns new Token instance.
 func NewToken() (*Token, error) {
 	t := &Token{}
@@ -50,34 +60,66 @@ func NewToken() (*Token, error) {
 
 // SaveToken is save auth token to file auth_token in config directory
 // Client will use this token instead by get new token every time.
-func (t *Token) SaveToken(token string) error {
-	file, err := os.Create(t.authTokenFile)
-	if err != nil {
-		prol.Fatal(err)
-	}
-	err = file.Chmod(0600)
+// The token is written to a temporary file only readable by the owner, then
+// renamed over auth_token, so the file is never readable by others nor
+// truncated.
+func (t *Token) SaveToken(token *CachedToken) error {
+	data, err := json.Marshal(token)
 	if err != nil {
-		prol.Errorln("Can't change mod of file auth_token")
+		return err
 	}
 
 	prol.Debugln("Saving auth token to: ", t.authTokenFile)
-	_, err = file.WriteString(token)
+	file, err := ioutil.TempFile(filepath.Dir(t.authTokenFile), "."+authTokenFilename+"-")
 	if err != nil {
-		prol.Fatal(err)
+		return err
+	}
+	// TempFile creates the file with mode 0600 already, make sure of it
+	// in case of a permissive umask on other systems.
+	if err := file.Chmod(0600); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
 	}
 	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
 		return err
 	}
-	return nil
+	return os.Rename(file.Name(), t.authTokenFile)
 }
 
-// ReadToken is read auth token was saved before
-func (t *Token) ReadToken() (string, error) {
+// ReadToken is read auth token was saved before. It returns nil without
+// error if no token was saved yet.
+func (t *Token) ReadToken() (*CachedToken, error) {
 	prol.Debugln("Reading auth token")
 	data, err := ioutil.ReadFile(t.authTokenFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
 	if err != nil {
-		prol.Fatal(err)
-		return "", err
+		return nil, err
+	}
+
+	token := &CachedToken{}
+	if err := json.Unmarshal(data, token); err != nil {
+		// Older agents saved the bare token.
+		token = &CachedToken{Token: string(data)}
+	}
+	if token.Token == "" {
+		return nil, nil
 	}
-	return string(data), nil
+	return token, nil
+}
+
+// DeleteToken removes the saved auth token, if any.
+func (t *Token) DeleteToken() error {
+	if err := os.Remove(t.authTokenFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
@@ -18,29 +18,60 @@
 package client
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"net/http"
-	"runtime"
+	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	prol "github.com/prometheus/common/log"
-	"github.com/spf13/viper"
 
 	"github.com/bizflycloud/bizfly-agent/auth"
 	"github.com/bizflycloud/bizfly-agent/config"
+	"github.com/bizflycloud/bizfly-agent/identity"
+	"github.com/bizflycloud/bizfly-agent/state"
 )
 
-// Client ...
+// Client is an HTTP client authenticating requests with the auth token of
+// the agent. It is safe for concurrent use, and should be shared by every
+// component so that they share the same token.
 type Client struct {
-	httpClient      *http.Client
-	defaultEndpoint string
-	token           string
-	authToken       *auth.Token
+	// ctx is done when the agent stops, requests are no longer retried.
+	ctx       context.Context
+	authToken *auth.Token
+	config    *config.Store
+	state     *state.Store
+	// identity is the identity of the host, nil if it can't be read.
+	identity *identity.Identity
+
+	// mu guards the HTTP client, the current token and its metadata.
+	mu         sync.Mutex
+	httpClient *http.Client
+	token      string
+	fetchedAt  time.Time
+	expiresAt  time.Time
+	// tokenChanged is closed when the token changes.
+	tokenChanged chan struct{}
+	// fetching is the token fetch in flight, if any.
+	fetching *tokenFetch
+
+	tokenRefreshes       prometheus.Counter
+	tokenRefreshFailures prometheus.Counter
+	tokenAgeDesc         *prometheus.Desc
+	tokenExpiryDesc      *prometheus.Desc
+	registeredDesc       *prometheus.Desc
+	requests             *prometheus.CounterVec
+}
+
+// tokenFetch is a fetch of a token, shared by all callers waiting for it.
+type tokenFetch struct {
+	done  chan struct{}
+	token string
+	err   error
 }
 
 // AgentCreated ...
@@ -49,54 +80,152 @@ type AgentCreated struct {
 	ID     string `json:"_id"`
 }
 
-// NewHTTPClient ...
-func NewHTTPClient() *Client {
+// NewHTTPClient returns a Client configured by cfg, saving the agent state
+// to st. Failed requests are no longer retried once ctx is done.
+func NewHTTPClient(ctx context.Context, cfg *config.Store, st *state.Store) (*Client, error) {
+	transport, err := newTransport(cfg.Get().HTTP)
+	if err != nil {
+		return nil, err
+	}
 	c := &Client{
-		httpClient: &http.Client{
-			Transport: &http.Transport{
-				DialContext: (&net.Dialer{
-					Timeout:   30 * time.Second,
-					KeepAlive: 30 * time.Second,
-				}).DialContext,
-				TLSHandshakeTimeout:   10 * time.Second,
-				ResponseHeaderTimeout: 10 * time.Second,
-				ExpectContinueTimeout: 1 * time.Second,
-			},
-		},
+		ctx:          ctx,
+		config:       cfg,
+		state:        st,
+		tokenChanged: make(chan struct{}),
+		tokenRefreshes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bizfly_agent_token_refreshes_total",
+			Help: "Number of auth tokens fetched.",
+		}),
+		tokenRefreshFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bizfly_agent_token_refresh_failures_total",
+			Help: "Number of failures to fetch an auth token.",
+		}),
+		tokenAgeDesc: prometheus.NewDesc(
+			"bizfly_agent_token_age_seconds",
+			"Seconds since the current auth token was fetched.",
+			nil, nil,
+		),
+		tokenExpiryDesc: prometheus.NewDesc(
+			"bizfly_agent_token_expiry_timestamp_seconds",
+			"Time the current auth token expires, if known.",
+			nil, nil,
+		),
+		registeredDesc: prometheus.NewDesc(
+			"bizfly_agent_registered",
+			"Whether the agent is registered and has an agent ID.",
+			nil, nil,
+		),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bizfly_agent_http_requests_total",
+			Help: "Number of request attempts to the API and the push gateway, by operation and outcome.",
+		}, []string{"operation", "outcome"}),
+		httpClient: &http.Client{Transport: transport},
 	}
 	if at, err := auth.NewToken(); at != nil {
 		c.authToken = at
 	} else {
 		prol.Warnf("Token cached is disabled, auth.NewToken() failed: %v", err)
 	}
-	return c
+	cfg.OnChange(func(old, new *config.Configurations) {
+		if old.HTTP == new.HTTP {
+			return
+		}
+		transport, err := newTransport(new.HTTP)
+		if err != nil {
+			prol.Errorf("failed to apply the new HTTP configuration, keep using the old one: %s", err)
+			return
+		}
+		c.mu.Lock()
+		prev := c.httpClient
+		c.httpClient = &http.Client{Transport: transport}
+		c.mu.Unlock()
+		prev.CloseIdleConnections()
+	})
+	cfg.OnChange(func(old, new *config.Configurations) {
+		// Credentials changed, the current token may belong to another agent
+		// or project. Clients that never fetched a token have nothing to do.
+		c.mu.Lock()
+		token, fetching := c.token, c.fetching != nil
+		c.mu.Unlock()
+		if old.AuthServer == new.AuthServer && old.Agent.ID == new.Agent.ID || token == "" {
+			return
+		}
+		// An agent ID set while a token is fetched comes from the
+		// registration of that fetch, which gets the token of the new agent.
+		if old.AuthServer == new.AuthServer && fetching {
+			return
+		}
+		// Listeners run in the goroutine changing the configuration, which
+		// may be fetching a token itself, and must not wait for the API.
+		go func() {
+			if _, err := c.AuthToken(); err != nil {
+				prol.Errorf("failed to get auth token for the new configuration: %s", err)
+			}
+		}()
+	})
+	return c, nil
 }
 
-// AuthToken get, save and set auth token
+// AuthToken get, save and set auth token. Only one token is fetched at a
+// time, concurrent callers wait for the token being fetched.
 func (c *Client) AuthToken() (string, error) {
-	if config.Config.AuthServer.DefaultEndpoint == "" {
-		prol.Fatalln("Default Endpoint is required")
+	c.mu.Lock()
+	if f := c.fetching; f != nil {
+		c.mu.Unlock()
+		<-f.done
+		return f.token, f.err
 	}
-	c.defaultEndpoint = config.Config.AuthServer.DefaultEndpoint
+	f := &tokenFetch{done: make(chan struct{})}
+	c.fetching = f
+	c.mu.Unlock()
 
-	if config.Config.Agent.ID == "" {
+	f.token, f.err = c.fetchToken()
+
+	c.mu.Lock()
+	c.fetching = nil
+	c.mu.Unlock()
+	close(f.done)
+	return f.token, f.err
+}
+
+// fetchToken gets a new auth token from the server, registering the agent
+// first if needed.
+func (c *Client) fetchToken() (token string, err error) {
+	defer func() {
+		if err != nil {
+			c.tokenRefreshFailures.Inc()
+		} else {
+			c.tokenRefreshes.Inc()
+		}
+	}()
+
+	cfg := c.config.Get()
+	if cfg.AuthServer.DefaultEndpoint == "" {
+		return "", errors.New("default endpoint is required")
+	}
+	if cfg.Agent.ID == "" {
 		// Register a new agent
 		err := c.RegisterAgents()
 		if err != nil {
-			prol.Fatalln(err)
+			return "", fmt.Errorf("failed to register agent: %s", err)
 		}
+		cfg = c.config.Get()
 	}
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/agents/tokens?agent_id=%s", c.defaultEndpoint, config.Config.Agent.ID), nil)
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/agents/tokens?agent_id=%s", cfg.AuthServer.DefaultEndpoint, cfg.Agent.ID), nil)
 	if err != nil {
 		prol.Error("Error reading request. ", err)
 		return "", err
 	}
 
-	req.Header.Set("X-Auth-Secret", config.Config.AuthServer.Secret)
-	req.Header.Set("X-Auth-Secret-Id", config.Config.AuthServer.SecretID)
-	req.Header.Set("X-Tenant-Id", config.Config.AuthServer.Project)
-	resp, err := c.httpClient.Do(req)
+	secret, secretID, err := cfg.AuthServer.Credentials()
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Auth-Secret", secret)
+	req.Header.Set("X-Auth-Secret-Id", secretID)
+	req.Header.Set("X-Tenant-Id", cfg.AuthServer.Project)
+	resp, err := c.doRetry(c.ctx, opToken, req, nil, 0)
 	if err != nil {
 		return "", err
 	}
@@ -106,47 +235,60 @@ func (c *Client) AuthToken() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	tokenStr := string(body)
-
 	if resp.StatusCode != http.StatusOK {
 		prol.Error("Error when get new auth token for agent")
+		return "", fmt.Errorf("unexpected status code %d while getting auth token", resp.StatusCode)
 	}
+	fetchedAt := time.Now()
+	tokenStr, expiresAt := parseToken(body, fetchedAt)
+	c.setToken(tokenStr, fetchedAt, expiresAt)
 	if c.authToken != nil {
-		_ = c.authToken.SaveToken(tokenStr)
+		cached := &auth.CachedToken{Token: tokenStr, FetchedAt: fetchedAt, ExpiresAt: expiresAt}
+		if err := c.authToken.SaveToken(cached); err != nil {
+			prol.Errorf("failed to cache auth token: %s", err)
+		}
+	}
+	if err := c.state.Update(func(st *state.State) {
+		st.Token = &state.Token{FetchedAt: fetchedAt, ExpiresAt: expiresAt}
+	}); err != nil {
+		prol.Errorf("failed to save token metadata to %s: %s", c.state.Path(), err)
 	}
 
-	c.token = tokenStr
 	return tokenStr, nil
 }
 
 // RegisterAgents create a new agent in server
 func (c *Client) RegisterAgents() error {
-	if config.Config.AuthServer.DefaultEndpoint == "" {
-		prol.Fatalln("Default Endpoint is required")
+	cfg := c.config.Get()
+	if cfg.AuthServer.DefaultEndpoint == "" {
+		return errors.New("default endpoint is required")
 	}
-	c.defaultEndpoint = config.Config.AuthServer.DefaultEndpoint
-
-	payload, err := json.Marshal(map[string]string{
-		"name":     config.Config.Agent.Name,
-		"hostname": config.Config.Agent.Hostname,
-		"runtime":  runtime.GOOS,
-	})
+	cur := c.currentIdentity(cfg)
+	agent := agentPayload(cur)
+	if clonedFrom := c.state.Get().ClonedFrom; clonedFrom != "" {
+		agent["cloned_from"] = clonedFrom
+	}
+	payload, err := json.Marshal(agent)
 	if err != nil {
-		prol.Fatalln("Can't register new agent")
+		return err
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/agents", c.defaultEndpoint), bytes.NewBuffer(payload))
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/agents", cfg.AuthServer.DefaultEndpoint), nil)
 	if err != nil {
 		prol.Error("Error reading request. ", err)
 		return err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Auth-Secret", config.Config.AuthServer.Secret)
-	req.Header.Set("X-Auth-Secret-Id", config.Config.AuthServer.SecretID)
-	req.Header.Set("X-Tenant-Id", config.Config.AuthServer.Project)
+	secret, secretID, err := cfg.AuthServer.Credentials()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Secret", secret)
+	req.Header.Set("X-Auth-Secret-Id", secretID)
+	req.Header.Set("X-Tenant-Id", cfg.AuthServer.Project)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.doRetry(c.ctx, opRegister, req, payload, 0)
 	if err != nil {
 		return err
 	}
@@ -156,49 +298,140 @@ func (c *Client) RegisterAgents() error {
 		return errors.New("Error when register new agent to systems")
 	}
 
-	var agent *AgentCreated
-	err = json.NewDecoder(resp.Body).Decode(&agent)
+	var created *AgentCreated
+	err = json.NewDecoder(resp.Body).Decode(&created)
 	if err != nil {
 		return err
 	}
 
-	config.Config.Agent.ID = agent.ID
-	viper.Set("agent.id", agent.ID)
-
-	// Write config to a file bizfly-agent.yaml
-	err = viper.WriteConfig()
+	// Save the agent ID to the state file, the configuration file is never
+	// written to. The agent is registered even if it can't be saved, and
+	// keeps its ID until it stops instead of registering again.
+	err = c.state.Update(func(st *state.State) {
+		st.AgentID = created.ID
+		st.RegisteredAt = time.Now()
+		st.Identity = &cur
+		st.ClonedFrom = ""
+	})
 	if err != nil {
-		prol.Error(err)
-		return err
+		prol.Errorf("failed to save agent ID %s to %s: %s", created.ID, c.state.Path(), err)
 	}
+	c.config.SetAgentID(created.ID)
 	return nil
 }
 
+// setToken makes token the current token.
+func (c *Client) setToken(token string, fetchedAt, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token, c.fetchedAt, c.expiresAt = token, fetchedAt, expiresAt
+	close(c.tokenChanged)
+	c.tokenChanged = make(chan struct{})
+}
+
+// currentToken returns the current token, loaded from the cache if there is
+// none yet. It returns an empty token if the token is known to be expired.
+func (c *Client) currentToken() string {
+	c.mu.Lock()
+	token, expiresAt := c.token, c.expiresAt
+	c.mu.Unlock()
+
+	if token == "" && c.authToken != nil {
+		cached, err := c.authToken.ReadToken()
+		if err != nil {
+			prol.Warnf("failed to read cached auth token: %s", err)
+		} else if cached != nil {
+			c.setToken(cached.Token, cached.FetchedAt, cached.ExpiresAt)
+			token, expiresAt = cached.Token, cached.ExpiresAt
+		}
+	}
+	if !expiresAt.IsZero() && time.Now().After(expiresAt) {
+		return ""
+	}
+	return token
+}
+
+// refreshToken returns a new token to replace the rejected token. If the
+// token was already replaced by another request, the new token is returned
+// instead of fetching another one.
+func (c *Client) refreshToken(rejected string) (string, error) {
+	c.mu.Lock()
+	token := c.token
+	c.mu.Unlock()
+	if token != "" && token != rejected {
+		return token, nil
+	}
+	return c.AuthToken()
+}
+
+// isAuthFailure reports whether the server rejected the token of a request.
+func isAuthFailure(code int) bool {
+	return code == http.StatusUnauthorized || code == http.StatusForbidden
+}
+
 // Do ...
 func (c *Client) Do(req *http.Request) (*http.Response, error) {
 	var err error
-	if c.token == "" && c.authToken != nil {
-		c.token, err = c.authToken.ReadToken()
-		if err != nil {
+	token := c.currentToken()
+	if token == "" {
+		if token, err = c.AuthToken(); err != nil {
 			return nil, err
 		}
 	}
-	req.Header.Add("Authorization", "Bearer "+c.token)
-	body, _ := ioutil.ReadAll(req.Body)
-	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	var body []byte
+	if req.Body != nil {
+		body, _ = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+	}
 
-	res, err := c.httpClient.Do(req)
-	if err != nil || res.StatusCode != http.StatusForbidden {
+	// Don't retry pushes for longer than the interval between them.
+	maxElapsed := time.Duration(c.config.Get().PushGW.WaitDuration) * time.Second
+	res, err := c.doRetry(c.ctx, opPush, req, body, maxElapsed)
+	if err != nil || !isAuthFailure(res.StatusCode) {
 		return res, err
 	}
+	res.Body.Close()
 
 	// Maybe token expired, get new one and retry
-	c.token, err = c.AuthToken()
+	token, err = c.refreshToken(token)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Body = ioutil.NopCloser(bytes.NewReader(body))
-	req.Header.Set("Authorization", "Bearer "+c.token)
-	return c.httpClient.Do(req)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return c.doRetry(c.ctx, opPush, req, body, maxElapsed)
+}
+
+// Describe implements prometheus.Collector.
+func (c *Client) Describe(ch chan<- *prometheus.Desc) {
+	c.tokenRefreshes.Describe(ch)
+	c.tokenRefreshFailures.Describe(ch)
+	ch <- c.tokenAgeDesc
+	ch <- c.tokenExpiryDesc
+	ch <- c.registeredDesc
+	c.requests.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Client) Collect(ch chan<- prometheus.Metric) {
+	c.tokenRefreshes.Collect(ch)
+	c.tokenRefreshFailures.Collect(ch)
+	c.requests.Collect(ch)
+
+	registered := 0.0
+	if c.config.Get().Agent.ID != "" {
+		registered = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.registeredDesc, prometheus.GaugeValue, registered)
+
+	c.mu.Lock()
+	fetchedAt, expiresAt := c.fetchedAt, c.expiresAt
+	c.mu.Unlock()
+	if !fetchedAt.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.tokenAgeDesc, prometheus.GaugeValue, time.Since(fetchedAt).Seconds())
+	}
+	if !expiresAt.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.tokenExpiryDesc, prometheus.GaugeValue, float64(expiresAt.Unix()))
+	}
 }
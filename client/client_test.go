@@ -0,0 +1,129 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/bizflycloud/bizfly-agent/config"
+	"github.com/bizflycloud/bizfly-agent/state"
+)
+
+// fakeAPI registers agents and gives them tokens.
+type fakeAPI struct {
+	*httptest.Server
+
+	mu            sync.Mutex
+	registrations int
+	tokens        int
+}
+
+func newFakeAPI(t *testing.T) *fakeAPI {
+	api := &fakeAPI{}
+	api.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/agents":
+			api.registrations++
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"_status": "OK", "_id": "agent-1"}`))
+		case r.Method == "GET" && r.URL.Path == "/agents/tokens":
+			api.tokens++
+			_, _ = w.Write([]byte(`{"token": "tok", "expires_in": 3600}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(api.Close)
+	return api
+}
+
+func (api *fakeAPI) counts() (registrations, tokens int) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return api.registrations, api.tokens
+}
+
+// newTestClient returns a client of api saving its state to stateFile. The
+// auth token isn't cached.
+func newTestClient(t *testing.T, api *fakeAPI, stateFile string) *Client {
+	cfg := &config.Configurations{
+		AuthServer: config.ServersConfigurations{
+			DefaultEndpoint: api.URL,
+			Secret:          "secret",
+			SecretID:        "secret-id",
+			Project:         "project",
+		},
+		Retry: config.Retry{InitialInterval: 1, MaxInterval: 1, MaxElapsedTime: 1},
+	}
+	st, err := state.Open(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewHTTPClient(context.Background(), config.NewStore(cfg), st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.authToken = nil
+	return c
+}
+
+func TestRegisterWithUnwritableState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	api := newFakeAPI(t)
+	stateDir := filepath.Join(dir, "state")
+	c := newTestClient(t, api, filepath.Join(stateDir, "state.json"))
+	// The state file can't be written under a regular file.
+	if err := ioutil.WriteFile(stateDir, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.AuthToken(); err != nil {
+		t.Fatalf("AuthToken() failed: %s", err)
+	}
+	if id := c.config.Get().Agent.ID; id != "agent-1" {
+		t.Errorf("agent ID = %q, want agent-1", id)
+	}
+	if st := c.state.Get(); st.AgentID != "agent-1" || st.RegisteredAt.IsZero() || st.Identity == nil {
+		t.Errorf("state = %+v, want the registration kept in memory", st)
+	}
+
+	if _, err := c.AuthToken(); err != nil {
+		t.Fatalf("second AuthToken() failed: %s", err)
+	}
+	registrations, tokens := api.counts()
+	if registrations != 1 {
+		t.Errorf("agent registered %d times, want once", registrations)
+	}
+	if tokens != 2 {
+		t.Errorf("got %d tokens, want 2", tokens)
+	}
+}
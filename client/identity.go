@@ -0,0 +1,154 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+
+	prol "github.com/prometheus/common/log"
+
+	"github.com/bizflycloud/bizfly-agent/config"
+	"github.com/bizflycloud/bizfly-agent/identity"
+	"github.com/bizflycloud/bizfly-agent/state"
+)
+
+// CheckIdentity sets the identity of the host, nil if it can't be read, and
+// compares it with the identity the agent last reported. If the host is a
+// clone of the one the agent registered on, the agent ID in the state file
+// belongs to the other host: it is forgotten so that the agent registers
+// again. So is the same agent ID in the configuration file, where older
+// agents wrote it, unless it was changed there or set by a flag or an
+// environment variable. It must be called before the agent ID of the state
+// file is used.
+func (c *Client) CheckIdentity(id *identity.Identity) error {
+	c.identity = id
+	st := c.state.Get()
+	if st.IgnoredAgentID != "" {
+		c.config.IgnoreAgentID(st.IgnoredAgentID)
+	}
+	if id == nil || st.Identity == nil || st.AgentID == "" || id.SameHost(st.Identity.Identity) {
+		return nil
+	}
+	cfg := c.config.Get()
+	legacyID := ""
+	if cfg.Agent.ID != "" {
+		if cfg.Source("agent.id") != config.SourceFile || cfg.Agent.ID != st.AgentID {
+			prol.Warnf("this host is a clone of the host agent %s registered on, but agent.id %s is set explicitly, the agent is not registered again", st.AgentID, cfg.Agent.ID)
+			return nil
+		}
+		legacyID = cfg.Agent.ID
+	}
+
+	prol.Warnf("this host is a clone of the host agent %s registered on, registering a new agent", st.AgentID)
+	if err := c.state.Update(func(st *state.State) {
+		st.ClonedFrom = st.AgentID
+		st.AgentID = ""
+		if legacyID != "" {
+			st.IgnoredAgentID = legacyID
+		}
+		st.RegisteredAt = time.Time{}
+		st.Token = nil
+		st.Identity = nil
+	}); err != nil {
+		return fmt.Errorf("failed to forget the agent ID of the cloned host: %s", err)
+	}
+	if legacyID != "" {
+		c.config.IgnoreAgentID(legacyID)
+	}
+	// The cached token belongs to the other agent too.
+	if c.authToken != nil {
+		if err := c.authToken.DeleteToken(); err != nil {
+			prol.Errorf("failed to delete the auth token of the cloned host: %s", err)
+		}
+	}
+	return nil
+}
+
+// ReportIdentity reports the name, the hostname and the host fingerprint of
+// the agent to the server if they changed since they were last reported, so
+// that a renamed host keeps its agent ID.
+func (c *Client) ReportIdentity() error {
+	cfg := c.config.Get()
+	if cfg.Agent.ID == "" {
+		// The identity is reported when the agent registers.
+		return nil
+	}
+	cur := c.currentIdentity(cfg)
+	prev := c.state.Get().Identity
+	if prev != nil && *prev == cur {
+		return nil
+	}
+
+	payload, err := json.Marshal(agentPayload(cur))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PATCH", fmt.Sprintf("%s/agents/%s", cfg.AuthServer.DefaultEndpoint, cfg.Agent.ID), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	secret, secretID, err := cfg.AuthServer.Credentials()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Secret", secret)
+	req.Header.Set("X-Auth-Secret-Id", secretID)
+	req.Header.Set("X-Tenant-Id", cfg.AuthServer.Project)
+
+	resp, err := c.doRetry(c.ctx, opUpdate, req, payload, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status code %d while reporting agent identity", resp.StatusCode)
+	}
+
+	if prev != nil {
+		prol.Infof("reported identity change of agent %s: name %q, hostname %q", cfg.Agent.ID, cur.Name, cur.Hostname)
+	}
+	return c.state.Update(func(st *state.State) { st.Identity = &cur })
+}
+
+// currentIdentity returns the identity of the agent with the configuration
+// cfg.
+func (c *Client) currentIdentity(cfg *config.Configurations) state.Identity {
+	id := state.Identity{Name: cfg.Agent.Name, Hostname: cfg.Agent.Hostname}
+	if c.identity != nil {
+		id.Identity = *c.identity
+	}
+	return id
+}
+
+// agentPayload returns the agent sent to the server for id.
+func agentPayload(id state.Identity) map[string]string {
+	agent := map[string]string{
+		"name":     id.Name,
+		"hostname": id.Hostname,
+		"runtime":  runtime.GOOS,
+	}
+	if id.Fingerprint != "" {
+		agent["fingerprint"] = id.Fingerprint
+	}
+	return agent
+}
@@ -0,0 +1,131 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+
+	prol "github.com/prometheus/common/log"
+)
+
+// Operations retried by the client, used as label of the request counter.
+const (
+	opRegister = "register"
+	opToken    = "token"
+	opUpdate   = "update"
+	opPush     = "push"
+)
+
+// Outcomes of a request attempt, used as label of the request counter.
+const (
+	outcomeSuccess   = "success"
+	outcomeFailure   = "failure"
+	outcomeRetry     = "retry"
+	outcomeExhausted = "exhausted"
+)
+
+// isRetryable reports whether a request that failed with err, or got res,
+// may succeed if sent again.
+func isRetryable(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch res.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return res.StatusCode >= 500 && res.StatusCode != http.StatusNotImplemented
+}
+
+// backoff returns how long to wait before the retry following attempt, with
+// full jitter: a random duration up to the exponential backoff.
+func backoff(attempt int, initial, max time.Duration) time.Duration {
+	d := initial
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// doRetry sends req with body, retrying it with exponential backoff while it
+// fails with a retryable error, for at most the max elapsed time of the retry
+// policy, or maxElapsed if it is shorter and positive. The last response or
+// error is returned when retries are exhausted. Once ctx is done, req is sent
+// only once and waiting for a retry is given up.
+func (c *Client) doRetry(ctx context.Context, op string, req *http.Request, body []byte, maxElapsed time.Duration) (*http.Response, error) {
+	policy := c.config.Get().Retry
+	initial := time.Duration(policy.InitialInterval) * time.Second
+	max := time.Duration(policy.MaxInterval) * time.Second
+	if limit := time.Duration(policy.MaxElapsedTime) * time.Second; maxElapsed <= 0 || limit < maxElapsed {
+		maxElapsed = limit
+	}
+
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		if body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+		}
+		c.mu.Lock()
+		httpClient := c.httpClient
+		c.mu.Unlock()
+		res, err := httpClient.Do(req)
+		if !isRetryable(res, err) {
+			if res.StatusCode < http.StatusBadRequest {
+				c.requests.WithLabelValues(op, outcomeSuccess).Inc()
+			} else {
+				c.requests.WithLabelValues(op, outcomeFailure).Inc()
+			}
+			return res, nil
+		}
+
+		wait := backoff(attempt, initial, max)
+		if time.Since(start)+wait > maxElapsed || ctx.Err() != nil {
+			c.requests.WithLabelValues(op, outcomeExhausted).Inc()
+			return res, err
+		}
+		c.requests.WithLabelValues(op, outcomeRetry).Inc()
+		if err != nil {
+			prol.Warnf("%s request failed, retrying in %s: %s", op, wait, err)
+		} else {
+			prol.Warnf("%s request failed with status %d, retrying in %s", op, res.StatusCode, wait)
+			_, _ = io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("%s request not retried: %s", op, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
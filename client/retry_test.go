@@ -0,0 +1,83 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bizflycloud/bizfly-agent/config"
+	"github.com/bizflycloud/bizfly-agent/state"
+)
+
+func TestDoRetryStopsWhenCancelled(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg := &config.Configurations{
+		// Without cancellation, the request would be retried for a minute.
+		Retry: config.Retry{InitialInterval: 10, MaxInterval: 10, MaxElapsedTime: 60},
+	}
+	c, err := NewHTTPClient(ctx, config.NewStore(cfg), &state.Store{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		_, err := c.doRetry(c.ctx, opPush, req, nil, 0)
+		done <- err
+	}()
+	// Let the first attempt fail before cancelling the wait for the retry.
+	for atomic.LoadInt32(&attempts) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("doRetry() succeeded, want an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("doRetry() still waits to retry after cancellation")
+	}
+
+	// Once cancelled, requests are sent once.
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	res, err := c.doRetry(c.ctx, opPush, req, nil, 0)
+	if err != nil {
+		t.Fatalf("doRetry() failed: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("doRetry() status = %d, want %d", res.StatusCode, http.StatusServiceUnavailable)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Errorf("server got %d attempts, want 2", n)
+	}
+}
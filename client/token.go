@@ -0,0 +1,167 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"time"
+
+	prol "github.com/prometheus/common/log"
+)
+
+const (
+	// minRefreshBefore is the least time before expiry a token is refreshed.
+	minRefreshBefore = 30 * time.Second
+	// refreshRetryInterval is how long to wait after a failed refresh.
+	refreshRetryInterval = 30 * time.Second
+)
+
+// tokenResponse is the body of a token response when the server gives the
+// lifetime of the token. Otherwise the body is the bare token.
+type tokenResponse struct {
+	Token     string `json:"token"`
+	ExpiresIn int64  `json:"expires_in"`
+}
+
+// parseToken returns the token in body and when it expires, zero if
+// unknown. The expiry is the expires_in given by the server, or else the
+// exp claim if the token is a JWT.
+func parseToken(body []byte, now time.Time) (string, time.Time) {
+	token := strings.TrimSpace(string(body))
+	var resp tokenResponse
+	if err := json.Unmarshal(body, &resp); err == nil && resp.Token != "" {
+		token = resp.Token
+		if resp.ExpiresIn > 0 {
+			return token, now.Add(time.Duration(resp.ExpiresIn) * time.Second)
+		}
+	}
+	return token, jwtExpiry(token)
+}
+
+// jwtExpiry returns the time of the exp claim of token, zero if token isn't
+// a JWT or has no exp claim. The signature isn't verified, the server does.
+func jwtExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp float64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(claims.Exp), 0)
+}
+
+// refreshAt returns when a token fetched at fetchedAt and expiring at
+// expiresAt should be refreshed: a tenth of its lifetime before it expires,
+// at least minRefreshBefore, minus a random jitter of up to another tenth so
+// that agents started together don't refresh together. Short-lived tokens,
+// or tokens that look expired because the clock is off, are refreshed no
+// sooner than half their lifetime and refreshRetryInterval after they were
+// fetched, so that the agent doesn't fetch tokens in a loop.
+func refreshAt(fetchedAt, expiresAt time.Time) time.Time {
+	lifetime := expiresAt.Sub(fetchedAt)
+	before := lifetime / 10
+	if before < minRefreshBefore {
+		before = minRefreshBefore
+	}
+	if lifetime > 0 {
+		before += time.Duration(rand.Int63n(int64(lifetime/10) + 1))
+	}
+	at := expiresAt.Add(-before)
+	if earliest := fetchedAt.Add(lifetime / 2); at.Before(earliest) {
+		at = earliest
+	}
+	if earliest := fetchedAt.Add(refreshRetryInterval); at.Before(earliest) {
+		at = earliest
+	}
+	return at
+}
+
+// RefreshInBackground refreshes the auth token before it expires, until ctx
+// is done. Tokens with an unknown expiry are refreshed when the server
+// rejects them.
+func (c *Client) RefreshInBackground(ctx context.Context) {
+	go func() {
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for {
+			c.mu.Lock()
+			fetchedAt, expiresAt, changed := c.fetchedAt, c.expiresAt, c.tokenChanged
+			c.mu.Unlock()
+
+			var wait <-chan time.Time
+			if !expiresAt.IsZero() {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(time.Until(refreshAt(fetchedAt, expiresAt)))
+				wait = timer.C
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+			case <-wait:
+				prol.Debugln("auth token expires soon, refreshing it")
+				if _, err := c.AuthToken(); err != nil {
+					prol.Errorf("failed to refresh auth token: %s", err)
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(refreshRetryInterval):
+					}
+				}
+			}
+		}
+	}()
+}
+
+// TokenStatus describes the current auth token of a Client.
+type TokenStatus struct {
+	// Valid reports whether there is a token that is not known to be expired.
+	Valid     bool
+	FetchedAt time.Time
+	// ExpiresAt is zero if the expiry of the token is unknown.
+	ExpiresAt time.Time
+}
+
+// TokenStatus returns the status of the current auth token.
+func (c *Client) TokenStatus() TokenStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return TokenStatus{
+		Valid:     c.token != "" && (c.expiresAt.IsZero() || time.Now().Before(c.expiresAt)),
+		FetchedAt: c.fetchedAt,
+		ExpiresAt: c.expiresAt,
+	}
+}
@@ -0,0 +1,84 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package client
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestRefreshAt(t *testing.T) {
+	fetchedAt := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		lifetime time.Duration
+		// The refresh is expected between min and max after fetchedAt.
+		min, max time.Duration
+	}{
+		{"a tenth of the lifetime before expiry, plus jitter", time.Hour, 48 * time.Minute, 54 * time.Minute},
+		{"at least minRefreshBefore before expiry", 2 * time.Minute, 78 * time.Second, 90 * time.Second},
+		{"no sooner than half the lifetime", 64 * time.Second, 32 * time.Second, 34 * time.Second},
+		{"no sooner than refreshRetryInterval", 20 * time.Second, refreshRetryInterval, refreshRetryInterval},
+		{"expired when fetched", -time.Minute, refreshRetryInterval, refreshRetryInterval},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				got := refreshAt(fetchedAt, fetchedAt.Add(tt.lifetime)).Sub(fetchedAt)
+				if got < tt.min || got > tt.max {
+					t.Fatalf("refreshAt() = fetchedAt + %s, want between %s and %s", got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestParseToken(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	jwt := func(claims string) string {
+		enc := base64.RawURLEncoding.EncodeToString
+		return enc([]byte(`{"alg":"HS256"}`)) + "." + enc([]byte(claims)) + ".sig"
+	}
+	exp := time.Date(2020, 6, 1, 13, 0, 0, 0, time.UTC)
+	withExp := jwt(`{"sub":"agent-1","exp":1591016400}`)
+
+	tests := []struct {
+		name      string
+		body      string
+		token     string
+		expiresAt time.Time
+	}{
+		{"expires_in", `{"token": "tok", "expires_in": 600}`, "tok", now.Add(10 * time.Minute)},
+		{"no expires_in", `{"token": "tok"}`, "tok", time.Time{}},
+		{"bare token", "tok\n", "tok", time.Time{}},
+		{"bare JWT", withExp, withExp, exp},
+		{"JWT without expires_in", `{"token": "` + withExp + `"}`, withExp, exp},
+		{"expires_in over JWT exp", `{"token": "` + withExp + `", "expires_in": 60}`, withExp, now.Add(time.Minute)},
+		{"JWT without exp", jwt(`{"sub":"agent-1"}`), jwt(`{"sub":"agent-1"}`), time.Time{}},
+		{"not a JWT", "a.b.c", "a.b.c", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, expiresAt := parseToken([]byte(tt.body), now)
+			if token != tt.token || !expiresAt.Equal(tt.expiresAt) {
+				t.Errorf("parseToken() = %q, %s, want %q, %s", token, expiresAt, tt.token, tt.expiresAt)
+			}
+		})
+	}
+}
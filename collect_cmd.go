@@ -0,0 +1,198 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/bizflycloud/bizfly-agent/collectors"
+	"github.com/bizflycloud/bizfly-agent/config"
+	"github.com/bizflycloud/bizfly-agent/metadata"
+)
+
+// collect implements `bizfly-agent collect`. It prints the metrics collected
+// by the collectors of the configuration, device labels rewritten, relabel
+// rules applied and agent and metadata labels added, every pushgw.waitduration
+// seconds or once, without registering the agent or pushing anything. It
+// returns the exit code.
+func collect(once bool, output string) int {
+	interval := defaultCollectInterval
+	cfg, err := loadConfig()
+	if err == nil {
+		err = collectors.Check(cfg)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s, using the default collectors\n", err)
+		cfg = &config.Configurations{Devices: config.Devices{Metrics: config.DefaultDeviceMetrics}}
+	} else {
+		interval = time.Duration(cfg.PushGW.WaitDuration) * time.Second
+	}
+
+	nc, err := collectors.NewNodeCollector(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create new collector: %s\n", err)
+		return 1
+	}
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(nc); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	md := metadata.New(cfg.Metadata)
+	md.Refresh()
+	g := withLabels(reg, func() map[string]string { return agentLabels(cfg, md) })
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		mfs, err := g.Gather()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "some metrics could not be gathered: %s\n", err)
+			if len(mfs) == 0 {
+				return 1
+			}
+		}
+		if err := writeMetrics(os.Stdout, mfs, output); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 1
+		}
+		if once {
+			return 0
+		}
+		select {
+		case <-sigs:
+			return 0
+		case <-time.After(interval):
+		}
+	}
+}
+
+// defaultCollectInterval is how often `bizfly-agent collect` collects when
+// the configuration can't be loaded.
+const defaultCollectInterval = 30 * time.Second
+
+// writeMetrics writes mfs to w in the Prometheus text format, or as JSON.
+func writeMetrics(w io.Writer, mfs []*dto.MetricFamily, output string) error {
+	if output == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(jsonFamilies(mfs))
+	}
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonFamily is a metric family in the JSON output of `bizfly-agent collect`.
+type jsonFamily struct {
+	Name    string       `json:"name"`
+	Help    string       `json:"help"`
+	Type    string       `json:"type"`
+	Metrics []jsonMetric `json:"metrics"`
+}
+
+type jsonMetric struct {
+	Labels map[string]string `json:"labels"`
+	// Value is set for counters, gauges and untyped metrics.
+	Value *jsonFloat `json:"value,omitempty"`
+	// Sum and Count are set for summaries and histograms.
+	Sum       *jsonFloat           `json:"sum,omitempty"`
+	Count     *uint64              `json:"count,omitempty"`
+	Quantiles map[string]jsonFloat `json:"quantiles,omitempty"`
+	Buckets   map[string]uint64    `json:"buckets,omitempty"`
+}
+
+// jsonFloat is a sample value, written as a string if it is NaN or infinite
+// since JSON has no numbers for them.
+type jsonFloat float64
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return json.Marshal(fmt.Sprint(v))
+	}
+	return json.Marshal(v)
+}
+
+func newJSONFloat(v float64) *jsonFloat {
+	f := jsonFloat(v)
+	return &f
+}
+
+var metricTypes = map[dto.MetricType]string{
+	dto.MetricType_COUNTER:   "counter",
+	dto.MetricType_GAUGE:     "gauge",
+	dto.MetricType_SUMMARY:   "summary",
+	dto.MetricType_UNTYPED:   "untyped",
+	dto.MetricType_HISTOGRAM: "histogram",
+}
+
+func jsonFamilies(mfs []*dto.MetricFamily) []jsonFamily {
+	out := make([]jsonFamily, 0, len(mfs))
+	for _, mf := range mfs {
+		f := jsonFamily{
+			Name:    mf.GetName(),
+			Help:    mf.GetHelp(),
+			Type:    metricTypes[mf.GetType()],
+			Metrics: make([]jsonMetric, 0, len(mf.Metric)),
+		}
+		for _, m := range mf.Metric {
+			jm := jsonMetric{Labels: map[string]string{}}
+			for _, l := range m.Label {
+				jm.Labels[l.GetName()] = l.GetValue()
+			}
+			switch {
+			case m.Counter != nil:
+				jm.Value = newJSONFloat(m.Counter.GetValue())
+			case m.Gauge != nil:
+				jm.Value = newJSONFloat(m.Gauge.GetValue())
+			case m.Untyped != nil:
+				jm.Value = newJSONFloat(m.Untyped.GetValue())
+			case m.Summary != nil:
+				jm.Sum, jm.Count = newJSONFloat(m.Summary.GetSampleSum()), m.Summary.SampleCount
+				jm.Quantiles = map[string]jsonFloat{}
+				for _, q := range m.Summary.Quantile {
+					jm.Quantiles[fmt.Sprint(q.GetQuantile())] = jsonFloat(q.GetValue())
+				}
+			case m.Histogram != nil:
+				jm.Sum, jm.Count = newJSONFloat(m.Histogram.GetSampleSum()), m.Histogram.SampleCount
+				jm.Buckets = map[string]uint64{}
+				for _, b := range m.Histogram.Bucket {
+					jm.Buckets[fmt.Sprint(b.GetUpperBound())] = b.GetCumulativeCount()
+				}
+			}
+			f.Metrics = append(f.Metrics, jm)
+		}
+		out = append(out, f)
+	}
+	return out
+}
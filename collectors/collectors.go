@@ -18,10 +18,12 @@
 package collectors
 
 import (
-	"errors"
 	"fmt"
 	"os"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/go-kit/kit/log"
 	"github.com/prometheus/client_golang/prometheus"
@@ -29,41 +31,109 @@ import (
 	prol "github.com/prometheus/common/log"
 	"github.com/prometheus/node_exporter/collector"
 
-	"github.com/bizflycloud/bizfly-agent/client"
+	"github.com/bizflycloud/bizfly-agent/config"
+	"github.com/bizflycloud/bizfly-agent/relabel"
 )
 
 // NewNodeCollector ...
-func NewNodeCollector(collectors []string) (*NodeCollector, error) {
-	logger := log.NewLogfmtLogger(os.Stdout)
-	c, err := collector.NewNodeCollector(logger, collectors...)
-	if err != nil {
+func NewNodeCollector(cfg *config.Configurations) (*NodeCollector, error) {
+	nc := &NodeCollector{
+		deviceMapping: newDeviceMappingCache(getDeviceMapping),
+	}
+	if err := nc.Configure(cfg.Collectors); err != nil {
 		return nil, err
 	}
-
-	nc := &NodeCollector{
-		collectFunc:  c.Collect,
-		describeFunc: c.Describe,
-		collectorsFunc: func() map[string]collector.Collector {
-			return c.Collectors
-		},
-		httpClient:    client.NewHTTPClient(),
-		deviceMetrics: []string{"node_filesystem_size_bytes", "node_filesystem_free_bytes"},
+	if err := nc.SetRelabel(cfg.Relabel); err != nil {
+		return nil, err
+	}
+	if err := nc.SetDeviceMetrics(cfg.Devices.Metrics); err != nil {
+		return nil, err
 	}
-
 	return nc, nil
 }
 
 // NodeCollector ...
 type NodeCollector struct {
+	// mu guards the node exporter collectors, replaced by Configure while
+	// no collection is running.
+	mu             sync.RWMutex
 	collectFunc    func(ch chan<- prometheus.Metric)
 	describeFunc   func(ch chan<- *prometheus.Desc)
 	collectorsFunc func() map[string]collector.Collector
-	httpClient     *client.Client
-	deviceMetrics  []string
+	deviceMetrics  *regexp.Regexp
+	deviceMapping  *deviceMappingCache
+	relabeler      *relabel.Relabeler
+}
+
+// Configure replaces the node exporter collectors by the ones enabled in cfg.
+// The current collectors are kept if cfg is invalid.
+func (n *NodeCollector) Configure(cfg map[string]config.Collector) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	prev := flagValues()
+	enabled, err := configure(cfg)
+	var c *collector.NodeCollector
+	if err == nil {
+		c, err = newNodeCollector(enabled)
+	}
+	if err != nil {
+		restoreFlags(prev)
+		return err
+	}
+	n.collectFunc = c.Collect
+	n.describeFunc = c.Describe
+	n.collectorsFunc = func() map[string]collector.Collector {
+		return c.Collectors
+	}
+	return nil
+}
+
+// newNodeCollector returns the node exporter collectors enabled. Collectors
+// panicking on invalid options, such as regular expressions, make it fail
+// instead.
+func newNodeCollector(enabled []string) (c *collector.NodeCollector, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid collector options: %v", r)
+		}
+	}()
+	return collector.NewNodeCollector(log.NewLogfmtLogger(os.Stderr), enabled...)
+}
+
+// SetRelabel replaces the relabel rules applied to collected metrics. The
+// current rules are kept if cfg is invalid.
+func (n *NodeCollector) SetRelabel(cfg config.Relabel) error {
+	r, err := relabel.New(cfg)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.relabeler = r
+	return nil
+}
+
+// SetDeviceMetrics sets the regular expressions matching the names of the
+// metrics with a volume_id label.
+func (n *NodeCollector) SetDeviceMetrics(patterns []string) error {
+	var re *regexp.Regexp
+	if len(patterns) > 0 {
+		var err error
+		if re, err = regexp.Compile("^(?:" + strings.Join(patterns, "|") + ")$"); err != nil {
+			return err
+		}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.deviceMetrics = re
+	return nil
 }
 
 // Collectors ...
 func (n *NodeCollector) Collectors() map[string]collector.Collector {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
 	return n.collectorsFunc()
 }
 
@@ -74,71 +144,122 @@ func (n *NodeCollector) Name() string {
 
 // Collect ...
 func (n *NodeCollector) Collect(ch chan<- prometheus.Metric) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
 	mChan := make(chan prometheus.Metric, 1)
 	go func() {
 		defer close(mChan)
 		n.collectFunc(mChan)
 	}()
 	for m := range mChan {
-		d := strings.ToLower(m.Desc().String())
-		if n.IsDeviceMetric(d) {
-			ch <- n.metricWithDeviceMappings(m)
-		} else {
-			ch <- m
+		if n.IsDeviceMetric(m.Desc().String()) {
+			m = n.metricWithDeviceMappings(m)
 		}
+		if n.relabeler != nil {
+			var keep bool
+			if m, keep = n.relabel(m); !keep {
+				continue
+			}
+		}
+		ch <- m
 	}
+	n.deviceMapping.Collect(ch)
 }
 
 // IsDeviceMetric ...
 func (n *NodeCollector) IsDeviceMetric(desc string) bool {
-	for _, s := range n.deviceMetrics {
-		if strings.Contains(desc, fmt.Sprintf(`fqname: "%s"`, s)) {
-			return true
-		}
+	if n.deviceMetrics == nil {
+		return false
 	}
-	return false
+	match := fqNameRegexp.FindStringSubmatch(desc)
+	return match != nil && n.deviceMetrics.MatchString(match[1])
 }
 
 // Describe ...
 func (n *NodeCollector) Describe(ch chan<- *prometheus.Desc) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
 	n.describeFunc(ch)
+	n.deviceMapping.Describe(ch)
 }
 
-var errDeviceNotInMapping = errors.New("device not in mapping")
+// volumeIDLabel is the label added to device metrics with the IDs of the
+// volumes the device is on.
+const volumeIDLabel = "volume_id"
 
 type deviceMappingMetric struct {
-	metric        prometheus.Metric
-	n             *NodeCollector
-	deviceMapping map[string]string
-}
-
-func (m deviceMappingMetric) updateDeviceLabel(label *dto.LabelPair) error {
-	mountName := label.GetValue()
-	for k, v := range m.deviceMapping {
-		if strings.HasPrefix(mountName, k) {
-			label.Value = &v
-			return nil
-		}
-	}
-	return errDeviceNotInMapping
+	metric   prometheus.Metric
+	n        *NodeCollector
+	resolver *deviceResolver
 }
 
 func (m deviceMappingMetric) Desc() *prometheus.Desc { return m.metric.Desc() }
 
 func (m deviceMappingMetric) Write(pb *dto.Metric) error {
 	e := m.metric.Write(pb)
+	var device string
 	for _, label := range pb.Label {
-		if label.GetName() == "device" {
-			err := m.updateDeviceLabel(label)
-			if err != nil {
-				prol.Errorf("Can't update label device %v", label)
-			}
-			break
+		switch label.GetName() {
+		case "device":
+			device = label.GetValue()
+		case volumeIDLabel:
+			return e
 		}
 	}
+	if device == "" {
+		return e
+	}
+	id := m.resolver.resolve(device)
+	if id == "" {
+		prol.Debugf("no volume found for device %s", device)
+		return e
+	}
+	name := volumeIDLabel
+	pb.Label = append(pb.Label, &dto.LabelPair{Name: &name, Value: &id})
+	sort.Slice(pb.Label, func(i, j int) bool { return pb.Label[i].GetName() < pb.Label[j].GetName() })
 	return e
 }
 
 func (n *NodeCollector) metricWithDeviceMappings(m prometheus.Metric) prometheus.Metric {
-	return deviceMappingMetric{metric: m, n: n, deviceMapping: getDeviceMapping()}
+	return deviceMappingMetric{metric: m, n: n, resolver: n.deviceMapping.get()}
+}
+
+var fqNameRegexp = regexp.MustCompile(`fqName: "([^"]*)"`)
+
+// relabeledMetric is a metric with the labels set by the relabel rules.
+type relabeledMetric struct {
+	desc *prometheus.Desc
+	pb   *dto.Metric
+}
+
+func (m relabeledMetric) Desc() *prometheus.Desc { return m.desc }
+
+func (m relabeledMetric) Write(pb *dto.Metric) error {
+	pb.Label = m.pb.Label
+	pb.Gauge = m.pb.Gauge
+	pb.Counter = m.pb.Counter
+	pb.Summary = m.pb.Summary
+	pb.Untyped = m.pb.Untyped
+	pb.Histogram = m.pb.Histogram
+	pb.TimestampMs = m.pb.TimestampMs
+	return nil
+}
+
+// relabel applies the relabel rules to m. It returns false if m is dropped.
+func (n *NodeCollector) relabel(m prometheus.Metric) (prometheus.Metric, bool) {
+	pb := &dto.Metric{}
+	if err := m.Write(pb); err != nil {
+		// Let the registry report the error.
+		return m, true
+	}
+	var name string
+	if match := fqNameRegexp.FindStringSubmatch(m.Desc().String()); match != nil {
+		name = match[1]
+	}
+	labels, keep := n.relabeler.Process(name, pb.Label)
+	if !keep {
+		return nil, false
+	}
+	pb.Label = labels
+	return relabeledMetric{desc: m.Desc(), pb: pb}, true
 }
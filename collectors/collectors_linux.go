@@ -30,3 +30,9 @@ var DefaultCollectors = []string{
 	"processes",
 	"systemd",
 }
+
+// DefaultOptions are the node exporter flags set for the collectors, unless
+// set by the collectors section of the configuration.
+var DefaultOptions = map[string]map[string]string{
+	"cpu": {"info": "true"},
+}
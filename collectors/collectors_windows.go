@@ -27,3 +27,7 @@ var DefaultCollectors = []string{
 	"netstat",
 	"processes",
 }
+
+// DefaultOptions are the node exporter flags set for the collectors, unless
+// set by the collectors section of the configuration.
+var DefaultOptions = map[string]map[string]string{}
@@ -0,0 +1,220 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package collectors
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	prol "github.com/prometheus/common/log"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/bizflycloud/bizfly-agent/config"
+)
+
+// flagPrefix is the prefix of the node exporter flags.
+const flagPrefix = "collector."
+
+var (
+	// cmdLineOnce records the node exporter flags set on the command line
+	// before any is changed by the configuration.
+	cmdLineOnce  sync.Once
+	cmdLineFlags map[string]bool
+)
+
+// setOnCommandLine returns the node exporter flags set on the command line,
+// which take precedence over the collectors section of the configuration.
+func setOnCommandLine() map[string]bool {
+	cmdLineOnce.Do(func() {
+		cmdLineFlags = map[string]bool{}
+		for _, f := range kingpin.CommandLine.Model().Flags {
+			if strings.HasPrefix(f.Name, flagPrefix) && f.String() != defaultValue(f) {
+				cmdLineFlags[f.Name] = true
+			}
+		}
+	})
+	return cmdLineFlags
+}
+
+func defaultValue(f *kingpin.FlagModel) string {
+	def := strings.Join(f.Default, ",")
+	if def == "" && f.IsBoolFlag() {
+		return "false"
+	}
+	return def
+}
+
+// regexpOptions are the node exporter flags holding regular expressions,
+// which the collectors compile without checking them.
+var regexpOptions = map[string]bool{
+	"collector.cpu.info.bugs-include":           true,
+	"collector.cpu.info.flags-include":          true,
+	"collector.diskstats.ignored-devices":       true,
+	"collector.filesystem.ignored-fs-types":     true,
+	"collector.filesystem.ignored-mount-points": true,
+	"collector.netclass.ignored-devices":        true,
+	"collector.netdev.device-blacklist":         true,
+	"collector.netdev.device-exclude":           true,
+	"collector.netdev.device-include":           true,
+	"collector.netdev.device-whitelist":         true,
+	"collector.netstat.fields":                  true,
+	"collector.powersupply.ignored-supplies":    true,
+	"collector.systemd.unit-blacklist":          true,
+	"collector.systemd.unit-exclude":            true,
+	"collector.systemd.unit-include":            true,
+	"collector.systemd.unit-whitelist":          true,
+	"collector.vmstat.fields":                   true,
+}
+
+// isCollectorFlag reports whether f enables or disables a collector.
+func isCollectorFlag(f *kingpin.FlagModel) bool {
+	return strings.HasPrefix(f.Name, flagPrefix) && f.IsBoolFlag() &&
+		!strings.Contains(strings.TrimPrefix(f.Name, flagPrefix), ".")
+}
+
+// Check reports whether the collectors section of c only names collectors
+// and options that exist, and whether regular expression options compile.
+// It returns a *config.ValidationError listing the problems found.
+func Check(c *config.Configurations) error {
+	e := &config.ValidationError{File: c.File()}
+	for name, cc := range c.Collectors {
+		f := kingpin.CommandLine.GetFlag(flagPrefix + name)
+		if f == nil || !isCollectorFlag(f.Model()) {
+			e.Problems = append(e.Problems, &config.FieldError{Field: "collectors." + name, Message: "no such collector"})
+			continue
+		}
+		for opt, v := range cc.Options {
+			field := "collectors." + name + ".options." + opt
+			flag := flagPrefix + name + "." + opt
+			if kingpin.CommandLine.GetFlag(flag) == nil {
+				e.Problems = append(e.Problems, &config.FieldError{Field: field, Message: "no such option"})
+				continue
+			}
+			if regexpOptions[flag] {
+				if _, err := regexp.Compile(v); err != nil {
+					e.Problems = append(e.Problems, &config.FieldError{Field: field, Message: err.Error()})
+				}
+			}
+		}
+	}
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	sort.Slice(e.Problems, func(i, j int) bool { return e.Problems[i].Field < e.Problems[j].Field })
+	return e
+}
+
+// configure sets the node exporter flags from cfg and DefaultOptions and
+// returns the collectors to run. Flags set on the command line are left
+// alone, and options removed from cfg get back their default value.
+func configure(cfg map[string]config.Collector) ([]string, error) {
+	cmdLine := setOnCommandLine()
+
+	defaults := map[string]bool{}
+	for _, name := range DefaultCollectors {
+		defaults[name] = true
+	}
+
+	var enabled []string
+	for _, f := range kingpin.CommandLine.Model().Flags {
+		if !strings.HasPrefix(f.Name, flagPrefix) {
+			continue
+		}
+		if !isCollectorFlag(f) {
+			if cmdLine[f.Name] {
+				continue
+			}
+			if err := f.Value.Set(defaultValue(f)); err != nil {
+				return nil, fmt.Errorf("can't reset --%s: %s", f.Name, err)
+			}
+			continue
+		}
+
+		name := strings.TrimPrefix(f.Name, flagPrefix)
+		on := defaults[name]
+		if c, ok := cfg[name]; ok && c.Enabled != nil {
+			on = *c.Enabled
+		}
+		if cmdLine[f.Name] {
+			on = f.String() == "true"
+		} else if err := f.Value.Set(fmt.Sprint(on)); err != nil {
+			return nil, fmt.Errorf("can't set --%s: %s", f.Name, err)
+		}
+		if on {
+			enabled = append(enabled, name)
+		}
+	}
+
+	options := map[string]map[string]string{}
+	for name, opts := range DefaultOptions {
+		options[name] = map[string]string{}
+		for opt, v := range opts {
+			options[name][opt] = v
+		}
+	}
+	for name, c := range cfg {
+		if options[name] == nil {
+			options[name] = map[string]string{}
+		}
+		for opt, v := range c.Options {
+			options[name][opt] = v
+		}
+	}
+	for name, opts := range options {
+		for opt, v := range opts {
+			flag := flagPrefix + name + "." + opt
+			if cmdLine[flag] {
+				continue
+			}
+			f := kingpin.CommandLine.GetFlag(flag)
+			if f == nil {
+				return nil, fmt.Errorf("collectors.%s.options.%s: no such option", name, opt)
+			}
+			if err := f.Model().Value.Set(v); err != nil {
+				return nil, fmt.Errorf("collectors.%s.options.%s: %s", name, opt, err)
+			}
+		}
+	}
+	sort.Strings(enabled)
+	return enabled, nil
+}
+
+// flagValues returns the values of the node exporter flags.
+func flagValues() map[string]string {
+	values := map[string]string{}
+	for _, f := range kingpin.CommandLine.Model().Flags {
+		if strings.HasPrefix(f.Name, flagPrefix) {
+			values[f.Name] = f.String()
+		}
+	}
+	return values
+}
+
+// restoreFlags sets the node exporter flags back to values.
+func restoreFlags(values map[string]string) {
+	for name, v := range values {
+		if f := kingpin.CommandLine.GetFlag(name); f != nil {
+			if err := f.Model().Value.Set(v); err != nil {
+				prol.Errorf("failed to restore --%s: %s", name, err)
+			}
+		}
+	}
+}
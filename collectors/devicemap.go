@@ -0,0 +1,167 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package collectors
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	prol "github.com/prometheus/common/log"
+)
+
+const (
+	// deviceMappingRefreshInterval is how often the device mapping is read
+	// again, on top of changes seen in deviceMappingDir.
+	deviceMappingRefreshInterval = 5 * time.Minute
+	// deviceMappingDelay groups the burst of events made when a volume is
+	// attached into a single refresh.
+	deviceMappingDelay = time.Second
+)
+
+// deviceMappingCache holds the device mapping shared by every collection.
+// It is refreshed periodically and when deviceMappingDir changes, and keeps
+// the last good mapping when it can't be read.
+type deviceMappingCache struct {
+	read func() (map[string]string, error)
+	once sync.Once
+
+	mu       sync.RWMutex
+	resolver *deviceResolver
+
+	refreshes   prometheus.Counter
+	failures    prometheus.Counter
+	lastSuccess prometheus.Gauge
+	devices     prometheus.Gauge
+}
+
+func newDeviceMappingCache(read func() (map[string]string, error)) *deviceMappingCache {
+	return &deviceMappingCache{
+		read: read,
+		refreshes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bizfly_agent_device_mapping_refreshes_total",
+			Help: "Number of times the device mapping was read.",
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bizfly_agent_device_mapping_refresh_failures_total",
+			Help: "Number of times the device mapping could not be read, the last good mapping is kept.",
+		}),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "bizfly_agent_device_mapping_last_refresh_success_timestamp_seconds",
+			Help: "Time the device mapping was last read successfully.",
+		}),
+		devices: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "bizfly_agent_device_mapping_devices",
+			Help: "Number of devices in the device mapping.",
+		}),
+	}
+}
+
+// get returns the resolver of the current mapping. The mapping is read, and
+// kept up to date from then on, the first time get is called.
+func (c *deviceMappingCache) get() *deviceResolver {
+	c.once.Do(func() {
+		c.resolver = newDeviceResolver(nil)
+		c.refresh()
+		go c.run()
+	})
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.resolver
+}
+
+// refresh reads the mapping, keeping the current one if that fails.
+func (c *deviceMappingCache) refresh() {
+	c.refreshes.Inc()
+	m, err := c.read()
+	if err != nil {
+		c.failures.Inc()
+		prol.Errorf("failed to read device mapping, keep using the last one: %s", err)
+		return
+	}
+	c.lastSuccess.SetToCurrentTime()
+	c.devices.Set(float64(len(m)))
+	r := newDeviceResolver(m)
+	c.mu.Lock()
+	c.resolver = r
+	c.mu.Unlock()
+}
+
+// run refreshes the mapping periodically and when deviceMappingDir changes.
+func (c *deviceMappingCache) run() {
+	var events <-chan fsnotify.Event
+	if deviceMappingDir != "" {
+		if w, err := fsnotify.NewWatcher(); err != nil {
+			prol.Warnf("device mapping is refreshed every %s only: %s", deviceMappingRefreshInterval, err)
+		} else if err := w.Add(deviceMappingDir); err != nil {
+			w.Close()
+			prol.Warnf("device mapping is refreshed every %s only: %s", deviceMappingRefreshInterval, err)
+		} else {
+			events = w.Events
+			go func() {
+				for err := range w.Errors {
+					prol.Errorf("error watching %s: %s", deviceMappingDir, err)
+				}
+			}()
+		}
+	}
+
+	ticker := time.NewTicker(deviceMappingRefreshInterval)
+	defer ticker.Stop()
+	var (
+		timer   *time.Timer
+		changed <-chan time.Time
+	)
+	for {
+		select {
+		case <-ticker.C:
+			c.refresh()
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if timer == nil {
+				timer = time.NewTimer(deviceMappingDelay)
+			} else {
+				timer.Reset(deviceMappingDelay)
+			}
+			changed = timer.C
+		case <-changed:
+			changed = nil
+			c.refresh()
+		}
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *deviceMappingCache) Describe(ch chan<- *prometheus.Desc) {
+	c.refreshes.Describe(ch)
+	c.failures.Describe(ch)
+	c.lastSuccess.Describe(ch)
+	c.devices.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *deviceMappingCache) Collect(ch chan<- prometheus.Metric) {
+	c.refreshes.Collect(ch)
+	c.failures.Collect(ch)
+	c.lastSuccess.Collect(ch)
+	c.devices.Collect(ch)
+}
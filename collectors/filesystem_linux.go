@@ -18,32 +18,92 @@
 package collectors
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 )
 
-func getDeviceMapping() map[string]string {
-	m := make(map[string]string)
-	fid, err := os.Open("/dev/disk/by-id")
+// deviceMappingDir is watched to refresh the device mapping when volumes are
+// attached or detached.
+const deviceMappingDir = "/dev/disk/by-id"
+
+// sysBlockDir has the serial numbers of disks, read when they have no entry in
+// deviceMappingDir.
+const sysBlockDir = "/sys/block"
+
+// getDeviceMapping maps disks, such as /dev/vda, to the IDs of their
+// volumes. Partitions are left out, they are resolved to their disk. IDs come
+// from /dev/disk/by-id, or from the serial in /sys/block for disks without
+// one. When a disk has several IDs, virtio IDs are preferred, then the first
+// in order.
+func getDeviceMapping() (map[string]string, error) {
+	m, serialErr := getSerialMapping()
+	names, err := readDirNames(deviceMappingDir)
 	if err != nil {
-		return nil
+		if serialErr != nil {
+			return nil, err
+		}
+		return m, nil
 	}
-	defer fid.Close()
+	sort.SliceStable(names, func(i, j int) bool {
+		return strings.HasPrefix(names[i], "virtio-") && !strings.HasPrefix(names[j], "virtio-")
+	})
 
-	devices, err := fid.Readdir(1024)
-	if err != nil {
-		return nil
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if partRegexp.MatchString(name) {
+			continue
+		}
+		src, err := filepath.EvalSymlinks(filepath.Join(deviceMappingDir, name))
+		if err != nil {
+			continue
+		}
+		if !seen[src] {
+			seen[src] = true
+			m[src] = strings.TrimPrefix(name, "virtio-")
+		}
 	}
 
-	for _, device := range devices {
-		parts := strings.TrimPrefix(device.Name(), "virtio-")
-		src, err := filepath.EvalSymlinks(filepath.Join(fid.Name(), device.Name()))
+	return m, nil
+}
+
+// getSerialMapping maps disks to the serial numbers in /sys/block, disks
+// without a serial number are left out.
+func getSerialMapping() (map[string]string, error) {
+	m := make(map[string]string)
+	names, err := readDirNames(sysBlockDir)
+	if err != nil {
+		return m, err
+	}
+	for _, name := range names {
+		b, err := ioutil.ReadFile(filepath.Join(sysBlockDir, name, "serial"))
 		if err != nil {
 			continue
 		}
-		m[src] = parts
+		if serial := strings.TrimSpace(string(b)); serial != "" {
+			m["/dev/"+name] = serial
+		}
 	}
+	return m, nil
+}
 
-	return m
+// partRegexp matches the IDs of partitions in /dev/disk/by-id.
+var partRegexp = regexp.MustCompile(`-part[0-9]+$`)
+
+// readDirNames returns the names of the entries of dir, sorted.
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
 }
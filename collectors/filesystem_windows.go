@@ -23,11 +23,18 @@ import (
 	"github.com/shirou/gopsutil/disk"
 )
 
-func getDeviceMapping() map[string]string {
+// deviceMappingDir is empty, the device mapping is refreshed periodically
+// only.
+const deviceMappingDir = ""
+
+func getDeviceMapping() (map[string]string, error) {
 	m := make(map[string]string)
-	partitions, _ := disk.Partitions(false)
+	partitions, err := disk.Partitions(false)
+	if err != nil {
+		return nil, err
+	}
 	for _, partition := range partitions {
 		m[partition.Mountpoint] = partition.Device
 	}
-	return m
+	return m, nil
 }
@@ -0,0 +1,91 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package collectors
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// deviceResolver resolves the device label of a metric to the IDs of the
+// volumes the device is on. Results are cached, a new resolver is made every
+// time the device mapping is refreshed.
+type deviceResolver struct {
+	// mapping maps devices to volume IDs.
+	mapping map[string]string
+	// prefixes are the keys of mapping, longest first.
+	prefixes []string
+
+	mu    sync.Mutex
+	cache map[string]string
+}
+
+func newDeviceResolver(mapping map[string]string) *deviceResolver {
+	r := &deviceResolver{mapping: mapping, cache: map[string]string{}}
+	for k := range mapping {
+		r.prefixes = append(r.prefixes, k)
+	}
+	sort.Slice(r.prefixes, func(i, j int) bool {
+		if len(r.prefixes[i]) != len(r.prefixes[j]) {
+			return len(r.prefixes[i]) > len(r.prefixes[j])
+		}
+		return r.prefixes[i] < r.prefixes[j]
+	})
+	return r
+}
+
+// resolve returns the volume IDs of device, joined by commas when the device
+// spans several volumes, or an empty string if it is on none.
+func (r *deviceResolver) resolve(device string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if v, ok := r.cache[device]; ok {
+		return v
+	}
+
+	ids := map[string]bool{}
+	for _, id := range r.lookup(device) {
+		ids[id] = true
+	}
+	var sorted []string
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Strings(sorted)
+	v := strings.Join(sorted, ",")
+	r.cache[device] = v
+	return v
+}
+
+// lookup returns the volume IDs of device. The exact device is tried first,
+// then the devices it is built on, then the longest device it starts with.
+func (r *deviceResolver) lookup(device string) []string {
+	if id, ok := r.mapping[device]; ok {
+		return []string{id}
+	}
+	if ids := r.lookupParents(device, 0); len(ids) > 0 {
+		return ids
+	}
+	for _, p := range r.prefixes {
+		if strings.HasPrefix(device, p) {
+			return []string{r.mapping[p]}
+		}
+	}
+	return nil
+}
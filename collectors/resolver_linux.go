@@ -0,0 +1,112 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package collectors
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// devDir holds the device files.
+	devDir = "/dev"
+	// sysBlock is where the kernel describes block devices.
+	sysBlock = "/sys/class/block"
+)
+
+// maxDeviceDepth bounds the stack of devices followed, such as LVM on md
+// RAID on partitions.
+const maxDeviceDepth = 8
+
+// lookupParents returns the volume IDs of device by its kernel name, or else
+// of the devices it is built on: the disk of a partition, the slaves of a
+// device mapper or md RAID device and the device holding the backing file
+// of a loop device.
+func (r *deviceResolver) lookupParents(device string, depth int) []string {
+	if depth > maxDeviceDepth {
+		return nil
+	}
+	name := kernelName(device)
+	if name == "" {
+		return nil
+	}
+	if id, ok := r.mapping["/dev/"+name]; ok {
+		return []string{id}
+	}
+
+	var parents []string
+	sys := filepath.Join(sysBlock, name)
+	if _, err := os.Stat(filepath.Join(sys, "partition")); err == nil {
+		// The parent directory of a partition is its disk.
+		if real, err := filepath.EvalSymlinks(sys); err == nil {
+			parents = append(parents, filepath.Base(filepath.Dir(real)))
+		}
+	}
+	if slaves, err := ioutil.ReadDir(filepath.Join(sys, "slaves")); err == nil {
+		for _, s := range slaves {
+			parents = append(parents, s.Name())
+		}
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(sys, "loop", "backing_file")); err == nil {
+		if dev := backingDevice(strings.TrimSpace(string(b))); dev != "" {
+			parents = append(parents, dev)
+		}
+	}
+
+	var ids []string
+	for _, p := range parents {
+		ids = append(ids, r.lookupParents("/dev/"+p, depth+1)...)
+	}
+	return ids
+}
+
+// kernelName returns the kernel name of device, such as dm-0 for
+// /dev/mapper/vg-root, or an empty string if device isn't a block device.
+func kernelName(device string) string {
+	// Diskstats metrics have the kernel name in their device label.
+	device = strings.TrimPrefix(device, "/dev/")
+	real, err := filepath.EvalSymlinks(filepath.Join(devDir, device))
+	if err != nil {
+		return ""
+	}
+	name := filepath.Base(real)
+	if _, err := os.Stat(filepath.Join(sysBlock, name)); err != nil {
+		return ""
+	}
+	return name
+}
+
+// backingDevice returns the kernel name of the block device file is on.
+func backingDevice(file string) string {
+	var st unix.Stat_t
+	if err := unix.Stat(file, &st); err != nil {
+		return ""
+	}
+	dev := uint64(st.Dev)
+	major, minor := unix.Major(dev), unix.Minor(dev)
+	real, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", major, minor))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(real)
+}
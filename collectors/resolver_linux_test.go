@@ -0,0 +1,142 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package collectors
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeBlockDevices makes devDir and sysBlock point to a tree with the disks
+// vda and vdb, their partitions vda1 and vdb1, and the device mapper device
+// dm-0, also known as /dev/mapper/vg-root, on both partitions.
+func fakeBlockDevices(t *testing.T) {
+	root, err := ioutil.TempDir("", "block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	mkdir := func(path string) {
+		if err := os.MkdirAll(filepath.Join(root, path), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	touch := func(path string) {
+		mkdir(filepath.Dir(path))
+		if err := ioutil.WriteFile(filepath.Join(root, path), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlink := func(target, path string) {
+		mkdir(filepath.Dir(path))
+		if err := os.Symlink(target, filepath.Join(root, path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"vda", "vda1", "vdb", "vdb1", "dm-0"} {
+		touch("dev/" + name)
+	}
+	symlink("../dm-0", "dev/mapper/vg-root")
+
+	for _, disk := range []string{"vda", "vdb"} {
+		mkdir("sys/devices/" + disk)
+		touch("sys/devices/" + disk + "/" + disk + "1/partition")
+		symlink("../../devices/"+disk, "sys/class/block/"+disk)
+		symlink("../../devices/"+disk+"/"+disk+"1", "sys/class/block/"+disk+"1")
+	}
+	mkdir("sys/devices/dm-0")
+	symlink("../../vda/vda1", "sys/devices/dm-0/slaves/vda1")
+	symlink("../../vdb/vdb1", "sys/devices/dm-0/slaves/vdb1")
+	symlink("../../devices/dm-0", "sys/class/block/dm-0")
+
+	oldDev, oldSys := devDir, sysBlock
+	devDir, sysBlock = filepath.Join(root, "dev"), filepath.Join(root, "sys/class/block")
+	t.Cleanup(func() { devDir, sysBlock = oldDev, oldSys })
+}
+
+func TestDeviceResolverLookup(t *testing.T) {
+	fakeBlockDevices(t)
+	r := newDeviceResolver(map[string]string{
+		"/dev/vda":  "vol-a",
+		"/dev/vdb":  "vol-b",
+		"/dev/vdb1": "vol-b1",
+		// xvdf isn't in the tree, it is only matched by name.
+		"/dev/xvdf": "vol-f",
+	})
+
+	tests := []struct {
+		device string
+		want   []string
+	}{
+		{"/dev/vda", []string{"vol-a"}},
+		// A partition is on the volume of its disk.
+		{"/dev/vda1", []string{"vol-a"}},
+		// Unless it has a volume of its own.
+		{"/dev/vdb", []string{"vol-b"}},
+		{"/dev/vdb1", []string{"vol-b1"}},
+		// Diskstats metrics have kernel names.
+		{"vda", []string{"vol-a"}},
+		{"vda1", []string{"vol-a"}},
+		{"vdb", []string{"vol-b"}},
+		{"vdb1", []string{"vol-b1"}},
+		// A device mapper device is on the volumes of its slaves.
+		{"/dev/mapper/vg-root", []string{"vol-a", "vol-b1"}},
+		{"dm-0", []string{"vol-a", "vol-b1"}},
+		// Devices unknown to the kernel fall back to the longest prefix.
+		{"/dev/xvdf2", []string{"vol-f"}},
+		{"/dev/vdc", nil},
+		{"tmpfs", nil},
+	}
+	for _, tt := range tests {
+		if got := r.lookup(tt.device); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lookup(%q) = %v, want %v", tt.device, got, tt.want)
+		}
+	}
+}
+
+func TestDeviceResolverResolve(t *testing.T) {
+	fakeBlockDevices(t)
+	r := newDeviceResolver(map[string]string{
+		"/dev/vda1": "vol-b",
+		"/dev/vdb1": "vol-a",
+	})
+
+	tests := []struct {
+		device string
+		want   string
+	}{
+		{"vda1", "vol-b"},
+		// Volume IDs are sorted.
+		{"dm-0", "vol-a,vol-b"},
+		{"/dev/vdc", ""},
+	}
+	for _, tt := range tests {
+		if got := r.resolve(tt.device); got != tt.want {
+			t.Errorf("resolve(%q) = %q, want %q", tt.device, got, tt.want)
+		}
+		// The second call is answered from the cache.
+		if got := r.resolve(tt.device); got != tt.want {
+			t.Errorf("cached resolve(%q) = %q, want %q", tt.device, got, tt.want)
+		}
+	}
+}
@@ -18,52 +18,172 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
-	"sync"
+	"runtime"
+	"strings"
 
 	"github.com/spf13/viper"
 )
 
-// Config is the global configuration.
-var Config Configurations
-var o sync.Once
+const fileName = "bizfly-agent.yaml"
 
-func init() {
-	o.Do(func() {
-		viper.SetConfigName("bizfly-agent")
-		viper.SetConfigType("yaml")
+// DefaultDeviceMetrics are the metrics with a volume_id label by default:
+// filesystem and diskstats metrics.
+var DefaultDeviceMetrics = []string{"node_filesystem_.+", "node_disk_.+"}
 
-		userCfgDir, err := os.UserConfigDir()
-		if err != nil {
-			panic("Can't get user config directory")
-		}
-		cfgDir := filepath.Join(userCfgDir, "bizfly-agent")
-		viper.AddConfigPath(cfgDir)
+// DefaultJob is the push gateway job of the agent by default.
+const DefaultJob = "bizfly-agent"
 
-		viper.AddConfigPath("/etc/bizfly-agent")
-		viper.AddConfigPath(".")
+// DefaultGrouping is the push gateway grouping key of the agent by default,
+// besides the job.
+var DefaultGrouping = map[string]string{
+	"hostname":    "{{.Hostname}}",
+	"instance":    "{{.Name}}",
+	"instance_id": "{{.AgentID}}",
+	"project_id":  "{{.ProjectID}}",
+	"runtime":     "{{.OS}}",
+}
 
-		if err := viper.ReadInConfig(); err != nil {
-			panic(err)
-		}
+// DefaultMetadataURL is the OpenStack metadata service.
+const DefaultMetadataURL = "http://169.254.169.254/openstack/latest/meta_data.json"
 
-		hostname, err := os.Hostname()
-		if err != nil {
-			panic("Can't get hostname.")
-		}
+// DefaultStatusAddress is where the status of the agent is served by default.
+const DefaultStatusAddress = "127.0.0.1:9199"
+
+// Dir returns the bizfly-agent directory in the user config directory.
+func Dir() (string, error) {
+	userCfgDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", errors.New("can't get user config directory")
+	}
+	return filepath.Join(userCfgDir, "bizfly-agent"), nil
+}
+
+// DefaultPaths returns the paths searched for the configuration file when
+// none is given: the user config directory, /etc/bizfly-agent and the
+// working directory.
+func DefaultPaths() []string {
+	var paths []string
+	if dir, err := Dir(); err == nil {
+		paths = append(paths, filepath.Join(dir, fileName))
+	}
+	return append(paths, filepath.Join("/etc/bizfly-agent", fileName), fileName)
+}
+
+// Load reads the configuration from the first file in paths that exists. A
+// path may also be a directory containing bizfly-agent.yaml. DefaultPaths
+// are searched when paths is empty.
+func Load(paths ...string) (*Configurations, error) {
+	if len(paths) == 0 {
+		paths = DefaultPaths()
+	}
+	file, err := find(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := newViper(file)
+	if err != nil {
+		return nil, err
+	}
+	inFile := fileKeys(v)
+
+	cfgDir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	v.SetDefault("agent.statefile", defaultStateFile(cfgDir))
+
+	v.SetDefault("pushgw.enabled", true)
+	v.SetDefault("pushgw.job", DefaultJob)
+	v.SetDefault("pushgw.grouping", DefaultGrouping)
+	v.SetDefault("pushgw.shutdowntimeout", 10)
+
+	v.SetDefault("web.telemetry-path", "/metrics")
+
+	v.SetDefault("status.address", DefaultStatusAddress)
 
-		// Config.Agent.Hostname = hostname
-		// Config.Agent.Name = hostname
+	v.SetDefault("devices.metrics", DefaultDeviceMetrics)
 
-		// Set config
-		viper.Set("agent.name", hostname)
-		viper.Set("agent.hostname", hostname)
+	v.SetDefault("metadata.url", DefaultMetadataURL)
+	v.SetDefault("metadata.timeout", 2)
+	v.SetDefault("metadata.refresh", 3600)
+	v.SetDefault("metadata.grouping", map[string]string{"server_id": "uuid"})
 
-		if err := viper.Unmarshal(&Config); err != nil {
-			panic(err)
+	v.SetDefault("retry.initialinterval", 1)
+	v.SetDefault("retry.maxinterval", 30)
+	v.SetDefault("retry.maxelapsedtime", 300)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, errors.New("can't get hostname")
+	}
+
+	// The name of the agent defaults to the hostname, and keeps its series
+	// when the host is renamed if it is set.
+	v.SetDefault("agent.name", hostname)
+
+	if err := applyOverrides(v); err != nil {
+		return nil, err
+	}
+
+	// The hostname of the agent is always the hostname, unless set by a flag
+	// or an environment variable.
+	if !overridden("agent.hostname") {
+		v.Set("agent.hostname", hostname)
+		delete(inFile, "agent.hostname")
+	}
+
+	c := &Configurations{file: file, settings: settings(v, inFile)}
+	if err := v.Unmarshal(c); err != nil {
+		return nil, fmt.Errorf("can't parse %s: %s", file, err)
+	}
+	if err := c.keepLabelCase(file); err != nil {
+		return nil, fmt.Errorf("can't parse %s: %s", file, err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func find(paths []string) (string, error) {
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			continue
 		}
-	})
+		if fi.IsDir() {
+			p = filepath.Join(p, fileName)
+			if _, err := os.Stat(p); err != nil {
+				continue
+			}
+		}
+		return filepath.Abs(p)
+	}
+	return "", fmt.Errorf("no configuration file found in %s", strings.Join(paths, ", "))
+}
+
+// defaultStateFile returns where the agent state is saved by default.
+func defaultStateFile(cfgDir string) string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(cfgDir, "state.json")
+	}
+	return "/var/lib/bizfly-agent/state.json"
+}
+
+// newViper returns a viper instance with file read into it.
+func newViper(file string) (*viper.Viper, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	v.SetConfigType("yaml")
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("can't read %s: %s", file, err)
+	}
+	return v, nil
 }
 
 // Configurations contains all configuration.
@@ -71,6 +191,73 @@ type Configurations struct {
 	Agent      AgentsConfigurations
 	AuthServer ServersConfigurations
 	PushGW     PushGateWay
+	Retry      Retry
+	HTTP       HTTP
+	Web        Web
+	Status     Status
+	Collectors map[string]Collector
+	Relabel    Relabel
+	Devices    Devices
+	Metadata   Metadata
+
+	// file is the configuration file c was loaded from.
+	file string
+	// settings are the effective values of the configuration keys.
+	settings []Setting
+}
+
+// File returns the path of the configuration file c was loaded from.
+func (c *Configurations) File() string {
+	return c.file
+}
+
+// withAgentID sets the agent ID of c to id, unless c already has one. It
+// reports whether c was changed.
+func (c *Configurations) withAgentID(id string) bool {
+	if id == "" || c.Agent.ID != "" {
+		return false
+	}
+	c.Agent.ID = id
+	c.settings = append([]Setting(nil), c.settings...)
+	for i := range c.settings {
+		if c.settings[i].Key == "agent.id" {
+			c.settings[i].Value, c.settings[i].Source = id, SourceState
+		}
+	}
+	return true
+}
+
+// withoutAgentID removes the agent ID of c if it is id. It reports whether c
+// was changed.
+func (c *Configurations) withoutAgentID(id string) bool {
+	if id == "" || c.Agent.ID != id {
+		return false
+	}
+	c.Agent.ID = ""
+	c.settings = append([]Setting(nil), c.settings...)
+	for i := range c.settings {
+		if c.settings[i].Key == "agent.id" {
+			c.settings[i].Value, c.settings[i].Source = "", SourceDefault
+		}
+	}
+	return true
+}
+
+// Source returns where the value of key comes from, SourceFlag, SourceEnv,
+// SourceFile, SourceState or SourceDefault.
+func (c *Configurations) Source(key string) string {
+	for _, s := range c.settings {
+		if s.Key == key {
+			return s.Source
+		}
+	}
+	return SourceDefault
+}
+
+// Settings returns the effective value of every configuration key, and
+// whether it comes from a flag, the environment, the file or a default.
+func (c *Configurations) Settings() []Setting {
+	return c.settings
 }
 
 // AgentsConfigurations is agent configuration.
@@ -78,6 +265,11 @@ type AgentsConfigurations struct {
 	ID       string
 	Name     string
 	Hostname string
+	// StateFile is where the agent saves its registered ID and other state.
+	StateFile string
+	// Labels are added to every metric that doesn't have them. Their values
+	// are templates executed with Facts.
+	Labels map[string]string
 }
 
 // ServersConfigurations contains server configuration.
@@ -86,10 +278,163 @@ type ServersConfigurations struct {
 	Secret          string
 	SecretID        string
 	Project         string
+	// SecretFile and SecretIDFile are files containing the secret and the
+	// secret ID, read instead of Secret and SecretID.
+	SecretFile   string `mapstructure:"secret_file"`
+	SecretIDFile string `mapstructure:"secretid_file"`
+	// CredentialHelper is a command printing the secret and the secret ID.
+	CredentialHelper string `mapstructure:"credential_helper"`
 }
 
 // PushGateWay contains push gateway configuration.
 type PushGateWay struct {
-	URL          string
+	// Enabled pushes metrics to the push gateway. It may be disabled when
+	// metrics are only scraped from web.listen-address.
+	Enabled bool
+	URL     string
+	// Job is the job of the metrics group, and Grouping the other labels of
+	// its grouping key. They are templates executed with Facts. Grouping
+	// labels rendered empty are left out.
+	Job          string
+	Grouping     map[string]string
 	WaitDuration int
+	// DeleteOnShutdown deletes the metrics group of the agent from the push
+	// gateway when the agent is stopped.
+	DeleteOnShutdown bool
+	// ShutdownTimeout is how long, in seconds, the agent waits for the final
+	// push when it is stopped.
+	ShutdownTimeout int
+}
+
+// Retry contains the retry policy of requests to the API and the push
+// gateway. Requests are retried with exponential backoff and full jitter.
+type Retry struct {
+	// InitialInterval is the backoff, in seconds, before the first retry.
+	InitialInterval int
+	// MaxInterval is the maximum backoff in seconds.
+	MaxInterval int
+	// MaxElapsedTime is how long, in seconds, a request is retried for.
+	// Pushes are never retried for longer than pushgw.waitduration.
+	MaxElapsedTime int
+}
+
+// Web contains configuration of the HTTP server exposing metrics to be
+// scraped by Prometheus.
+type Web struct {
+	// ListenAddress is the address to listen on, the server is disabled if it
+	// is empty.
+	ListenAddress string `mapstructure:"listen-address"`
+	// TelemetryPath is the path metrics are exposed at.
+	TelemetryPath string `mapstructure:"telemetry-path"`
+	// TLSCertFile and TLSKeyFile enable TLS. They are read again when they
+	// change, so the certificate can be renewed without a restart.
+	TLSCertFile string `mapstructure:"tls-cert-file"`
+	TLSKeyFile  string `mapstructure:"tls-key-file"`
+	// BasicAuthUsername and BasicAuthPassword enable basic authentication.
+	BasicAuthUsername string `mapstructure:"basic-auth-username"`
+	BasicAuthPassword string `mapstructure:"basic-auth-password"`
+}
+
+// Collector contains configuration of a node exporter collector.
+type Collector struct {
+	// Enabled enables or disables the collector. By default, only the
+	// collectors in collectors.DefaultCollectors are enabled.
+	Enabled *bool
+	// Options are node exporter flags of the collector, without their
+	// collector.<name>. prefix, such as ignored-mount-points for the
+	// filesystem collector.
+	Options map[string]string
+}
+
+// Devices contains configuration of the volume_id label of device metrics.
+type Devices struct {
+	// Metrics are regular expressions matching the names of the metrics
+	// whose device label is resolved to a volume_id label.
+	Metrics []string
+}
+
+// Metadata contains configuration of the labels read from the metadata of the
+// cloud instance the agent runs on.
+type Metadata struct {
+	// Enabled reads the instance metadata and adds Grouping and Labels.
+	Enabled bool
+	// URL is the OpenStack meta_data.json of the metadata service.
+	URL string
+	// ConfigDrive is where the config drive is mounted. Its meta_data.json
+	// is read instead of the metadata service if it exists.
+	ConfigDrive string `mapstructure:"config_drive"`
+	// Timeout is how long, in seconds, to wait for the metadata service.
+	Timeout int
+	// Refresh is how long, in seconds, the metadata is cached.
+	Refresh int
+	// Grouping and Labels map label names to metadata fields, such as uuid,
+	// availability_zone or meta.role for the role key of the user metadata.
+	// Grouping labels are added to the push gateway grouping key, Labels to
+	// every metric that doesn't have them.
+	Grouping map[string]string
+	Labels   map[string]string
+}
+
+// Relabel contains the rules rewriting the labels of collected metrics,
+// applied in order before static labels are added.
+type Relabel struct {
+	Rules []RelabelRule
+	// StaticLabels are added to every metric that doesn't have them.
+	StaticLabels map[string]string `mapstructure:"static_labels"`
+}
+
+// Actions of relabel rules.
+const (
+	// RelabelKeep drops metrics whose source labels don't match regex.
+	RelabelKeep = "keep"
+	// RelabelDrop drops metrics whose source labels match regex.
+	RelabelDrop = "drop"
+	// RelabelReplace sets target_label to replacement, with $1... set to
+	// the groups of regex, if the source labels match regex.
+	RelabelReplace = "replace"
+	// RelabelHashMod sets target_label to the hash of the source labels
+	// modulo modulus.
+	RelabelHashMod = "hashmod"
+	// RelabelLabelDrop removes the labels whose name matches regex.
+	RelabelLabelDrop = "labeldrop"
+	// RelabelLabelKeep removes the labels whose name doesn't match regex.
+	RelabelLabelKeep = "labelkeep"
+)
+
+// RelabelRule is a Prometheus relabel rule. The metric name is the label
+// __name__, the source labels of keep and drop default to it.
+type RelabelRule struct {
+	Action       string
+	SourceLabels []string `mapstructure:"source_labels"`
+	// Separator joins the values of the source labels, ; by default.
+	Separator   string
+	Regex       string
+	TargetLabel string `mapstructure:"target_label"`
+	Replacement string
+	Modulus     uint64
+}
+
+// Status contains configuration of the local endpoints serving the health and
+// the status of the agent.
+type Status struct {
+	// Address is a loopback host:port, or unix: followed by the path of a
+	// unix socket. The endpoints are disabled if it is empty.
+	Address string
+}
+
+// HTTP contains configuration of the connections to the API and the push
+// gateway.
+type HTTP struct {
+	// ProxyURL is the proxy requests go through, with its credentials if
+	// any. HTTP_PROXY, HTTPS_PROXY and NO_PROXY are used if it is empty.
+	ProxyURL string `mapstructure:"proxy_url"`
+	// CAFile is a bundle of CA certificates trusted besides the system ones.
+	CAFile string `mapstructure:"ca_file"`
+	// CertFile and KeyFile are the client certificate and key for mTLS.
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// MinTLSVersion is the minimum TLS version, 1.0, 1.1, 1.2 or 1.3.
+	MinTLSVersion string `mapstructure:"min_tls_version"`
+	// ServerName overrides the name used to verify server certificates.
+	ServerName string `mapstructure:"server_name"`
 }
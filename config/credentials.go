@@ -0,0 +1,110 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// credentialHelperTimeout is how long the credential helper may run.
+const credentialHelperTimeout = 10 * time.Second
+
+// helperOutput is what the credential helper prints on its stdout.
+type helperOutput struct {
+	Secret   string `json:"secret"`
+	SecretID string `json:"secret_id"`
+}
+
+// Credentials returns the secret and the secret ID used to authenticate with
+// the API. They are read again on every call, so rotated secrets are picked
+// up without reloading the configuration. The credential helper takes
+// precedence over the secret files, which take precedence over the values
+// set in the configuration.
+func (s *ServersConfigurations) Credentials() (secret, secretID string, err error) {
+	secret, secretID = s.Secret, s.SecretID
+
+	if s.SecretFile != "" {
+		if secret, err = readSecretFile(s.SecretFile); err != nil {
+			return "", "", err
+		}
+	}
+	if s.SecretIDFile != "" {
+		if secretID, err = readSecretFile(s.SecretIDFile); err != nil {
+			return "", "", err
+		}
+	}
+
+	if s.CredentialHelper != "" {
+		out, err := runCredentialHelper(s.CredentialHelper)
+		if err != nil {
+			return "", "", err
+		}
+		if out.Secret != "" {
+			secret = out.Secret
+		}
+		if out.SecretID != "" {
+			secretID = out.SecretID
+		}
+	}
+
+	if secret == "" || secretID == "" {
+		return "", "", errors.New("secret and secret ID are required")
+	}
+	return secret, secretID, nil
+}
+
+func readSecretFile(name string) (string, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", fmt.Errorf("can't read secret: %s", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// runCredentialHelper runs command, without a shell, and parses the JSON
+// object it prints, such as {"secret": "...", "secret_id": "..."}.
+func runCredentialHelper(command string) (*helperOutput, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("credential helper is empty")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), credentialHelperTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("credential helper failed: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	out := &helperOutput{}
+	if err := json.Unmarshal(stdout.Bytes(), out); err != nil {
+		return nil, fmt.Errorf("can't parse output of credential helper: %s", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,87 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// labelMaps returns the fields of c whose keys are label names, by
+// configuration key.
+func (c *Configurations) labelMaps() map[string]*map[string]string {
+	return map[string]*map[string]string{
+		"agent.labels":          &c.Agent.Labels,
+		"pushgw.grouping":       &c.PushGW.Grouping,
+		"relabel.static_labels": &c.Relabel.StaticLabels,
+		"metadata.grouping":     &c.Metadata.Grouping,
+		"metadata.labels":       &c.Metadata.Labels,
+	}
+}
+
+// keepLabelCase reads the label maps of c again from file. Viper lowercases
+// the keys of maps, but label names are case-sensitive.
+func (c *Configurations) keepLabelCase(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var raw map[interface{}]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for key, labels := range c.labelMaps() {
+		v, ok := lookupFold(raw, strings.Split(key, "."))
+		if !ok {
+			continue
+		}
+		m, ok := v.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		out := make(map[string]string, len(m))
+		for k, v := range m {
+			if v == nil {
+				v = ""
+			}
+			out[fmt.Sprint(k)] = fmt.Sprint(v)
+		}
+		*labels = out
+	}
+	return nil
+}
+
+// lookupFold returns the value at path in m, matching keys case-insensitively
+// like Viper.
+func lookupFold(m map[interface{}]interface{}, path []string) (interface{}, bool) {
+	for k, v := range m {
+		if !strings.EqualFold(fmt.Sprint(k), path[0]) {
+			continue
+		}
+		if len(path) == 1 {
+			return v, true
+		}
+		if sub, ok := v.(map[interface{}]interface{}); ok {
+			return lookupFold(sub, path[1:])
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,180 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// EnvPrefix is the prefix of environment variables overriding configuration
+// keys, pushgw.url is overridden by BIZFLY_AGENT_PUSHGW_URL.
+const EnvPrefix = "BIZFLY_AGENT"
+
+// key is a configuration key that can be overridden by an environment
+// variable or a flag.
+type key struct {
+	name   string
+	help   string
+	secret bool
+}
+
+var keys = []key{
+	{name: "agent.id", help: "ID of the agent, saved to the state file when the agent is registered."},
+	{name: "agent.name", help: "Name of the agent, default to the hostname. Set it to keep the same series when the host is renamed."},
+	{name: "agent.hostname", help: "Hostname reported by the agent, default to the hostname."},
+	{name: "agent.statefile", help: "File where the agent saves its registered ID and other state."},
+	{name: "authserver.defaultendpoint", help: "URL of the BizFly Cloud API."},
+	{name: "authserver.secret", help: "Secret to authenticate with the API.", secret: true},
+	{name: "authserver.secretid", help: "ID of the secret to authenticate with the API.", secret: true},
+	{name: "authserver.secret_file", help: "File containing the secret, read instead of authserver.secret."},
+	{name: "authserver.secretid_file", help: "File containing the secret ID, read instead of authserver.secretid."},
+	{name: "authserver.credential_helper", help: "Command printing the secret and the secret ID as JSON."},
+	{name: "authserver.project", help: "Project ID of the agent."},
+	{name: "pushgw.enabled", help: "Push metrics to the push gateway, disable to only serve them on web.listen-address."},
+	{name: "pushgw.url", help: "URL of the push gateway."},
+	{name: "pushgw.job", help: "Job of the metrics pushed to the push gateway, a template of host facts."},
+	{name: "pushgw.waitduration", help: "Seconds between two pushes."},
+	{name: "pushgw.deleteonshutdown", help: "Delete metrics of the agent from the push gateway when it is stopped."},
+	{name: "pushgw.shutdowntimeout", help: "Seconds to wait for the final push when the agent is stopped."},
+	{name: "web.listen-address", help: "Address to serve metrics on, such as :9100, disabled if empty."},
+	{name: "web.telemetry-path", help: "Path metrics are served at."},
+	{name: "web.tls-cert-file", help: "Certificate to serve metrics over TLS."},
+	{name: "web.tls-key-file", help: "Key of the certificate to serve metrics over TLS."},
+	{name: "web.basic-auth-username", help: "Username required to read metrics."},
+	{name: "web.basic-auth-password", help: "Password required to read metrics.", secret: true},
+	{name: "status.address", help: "Local address or unix:PATH socket serving /healthz, /readyz and /status, disabled if empty."},
+	{name: "http.proxy_url", help: "Proxy for requests to the API and the push gateway.", secret: true},
+	{name: "http.ca_file", help: "CA certificates trusted besides the system ones."},
+	{name: "http.cert_file", help: "Client certificate for mTLS."},
+	{name: "http.key_file", help: "Key of the client certificate for mTLS."},
+	{name: "http.min_tls_version", help: "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3."},
+	{name: "http.server_name", help: "Name used to verify server certificates."},
+	{name: "metadata.enabled", help: "Add labels read from the metadata of the cloud instance."},
+	{name: "metadata.url", help: "URL of the OpenStack meta_data.json of the metadata service."},
+	{name: "metadata.config_drive", help: "Mount point of the config drive, read instead of the metadata service."},
+	{name: "metadata.timeout", help: "Seconds to wait for the metadata service."},
+	{name: "metadata.refresh", help: "Seconds the instance metadata is cached."},
+	{name: "retry.initialinterval", help: "Seconds to wait before the first retry of a failed request."},
+	{name: "retry.maxinterval", help: "Maximum seconds to wait between two retries of a failed request."},
+	{name: "retry.maxelapsedtime", help: "Seconds to retry a failed request for, 0 disables retries."},
+}
+
+// flagValues holds the configuration keys set by flags.
+var flagValues = map[string]string{}
+
+// Sources of a configuration value, from the highest precedence to the
+// lowest.
+const (
+	SourceFlag    = "flag"
+	SourceEnv     = "env"
+	SourceFile    = "file"
+	SourceState   = "state"
+	SourceDefault = "default"
+)
+
+// Setting is the effective value of a configuration key.
+type Setting struct {
+	Key    string
+	Value  string
+	Source string
+	Secret bool
+}
+
+// AddFlags adds a flag for every configuration key to a Kingpin
+// application. A key set by a flag takes precedence over the environment,
+// which takes precedence over the configuration file, then the default.
+func AddFlags(a *kingpin.Application) {
+	for _, k := range keys {
+		k := k
+		val := new(string)
+		a.Flag(k.name, fmt.Sprintf("%s Overrides %s in the configuration file.", k.help, k.name)).
+			PlaceHolder(strings.ToUpper(strings.Replace(k.name[strings.LastIndex(k.name, ".")+1:], "-", "_", -1))).
+			Action(func(*kingpin.ParseContext) error {
+				flagValues[k.name] = *val
+				return nil
+			}).
+			StringVar(val)
+	}
+}
+
+// EnvName returns the environment variable overriding key.
+func EnvName(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+// applyOverrides binds the environment variables and applies the flags of
+// every configuration key to v.
+func applyOverrides(v *viper.Viper) error {
+	for _, k := range keys {
+		if err := v.BindEnv(k.name, EnvName(k.name)); err != nil {
+			return err
+		}
+		if val, ok := flagValues[k.name]; ok {
+			v.Set(k.name, val)
+		}
+	}
+	return nil
+}
+
+// overridden reports whether key is set by a flag or an environment variable.
+func overridden(key string) bool {
+	if _, ok := flagValues[key]; ok {
+		return true
+	}
+	_, ok := os.LookupEnv(EnvName(key))
+	return ok
+}
+
+// fileKeys returns the configuration keys set in the file read into v. It
+// must be called before defaults and overrides are applied to v.
+func fileKeys(v *viper.Viper) map[string]bool {
+	set := map[string]bool{}
+	for _, k := range keys {
+		if v.IsSet(k.name) {
+			set[k.name] = true
+		}
+	}
+	return set
+}
+
+// settings returns the effective value and source of every key of v.
+// inFile holds the keys whose value comes from the configuration file.
+func settings(v *viper.Viper, inFile map[string]bool) []Setting {
+	ss := make([]Setting, 0, len(keys))
+	for _, k := range keys {
+		s := Setting{Key: k.name, Value: v.GetString(k.name), Secret: k.secret}
+		_, flag := flagValues[k.name]
+		switch {
+		case flag:
+			s.Source = SourceFlag
+		case overridden(k.name):
+			s.Source = SourceEnv
+		case inFile[k.name]:
+			s.Source = SourceFile
+		default:
+			s.Source = SourceDefault
+		}
+		ss = append(ss, s)
+	}
+	return ss
+}
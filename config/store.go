@@ -0,0 +1,143 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package config
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Store holds the current configuration of a running agent and swaps in a
+// new one when the configuration file is reloaded.
+type Store struct {
+	// current holds the current *Configurations.
+	current atomic.Value
+
+	// mu serializes reloads and updates of the configuration.
+	mu        sync.Mutex
+	listeners []func(old, new *Configurations)
+	checks    []func(*Configurations) error
+	// agentID is the registered agent ID set by SetAgentID.
+	agentID string
+	// ignoredAgentID is the agent ID ignored by IgnoreAgentID.
+	ignoredAgentID string
+}
+
+// NewStore returns a Store holding c.
+func NewStore(c *Configurations) *Store {
+	s := &Store{}
+	s.current.Store(c)
+	return s
+}
+
+// Get returns the current configuration. The returned value is shared and
+// must not be modified.
+func (s *Store) Get() *Configurations {
+	return s.current.Load().(*Configurations)
+}
+
+// OnChange registers f to be called with the old and the new configuration
+// every time a new configuration is swapped in.
+func (s *Store) OnChange(f func(old, new *Configurations)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, f)
+}
+
+// AddCheck registers f to validate new configurations, on top of Validate,
+// before they are swapped in. It is used by components with settings that
+// can't be checked by this package.
+func (s *Store) AddCheck(f func(*Configurations) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checks = append(s.checks, f)
+}
+
+// Reload re-reads the configuration file. If the file can't be read or the
+// new configuration is invalid, the current configuration is kept.
+func (s *Store) Reload() error {
+	s.mu.Lock()
+	c, err := Load(s.Get().File())
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	for _, check := range s.checks {
+		if err := check(c); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	c.withoutAgentID(s.ignoredAgentID)
+	c.withAgentID(s.agentID)
+	notify := s.swapLocked(c)
+	s.mu.Unlock()
+
+	notify()
+	return nil
+}
+
+// SetAgentID sets the registered agent ID, used whenever the configuration
+// doesn't set one. It is kept across reloads but never written to the
+// configuration file, which is treated as read-only.
+func (s *Store) SetAgentID(id string) {
+	s.mu.Lock()
+	s.agentID = id
+	c := *s.Get()
+	if !c.withAgentID(id) {
+		s.mu.Unlock()
+		return
+	}
+	notify := s.swapLocked(&c)
+	s.mu.Unlock()
+
+	notify()
+}
+
+// IgnoreAgentID ignores the agent ID id when the configuration file sets it,
+// also after reloads. It is used for the agent ID older agents wrote to the
+// configuration file, when the host turns out to be a clone of the host the
+// agent ID belongs to.
+func (s *Store) IgnoreAgentID(id string) {
+	s.mu.Lock()
+	s.ignoredAgentID = id
+	c := *s.Get()
+	if !c.withoutAgentID(id) {
+		s.mu.Unlock()
+		return
+	}
+	c.withAgentID(s.agentID)
+	notify := s.swapLocked(&c)
+	s.mu.Unlock()
+
+	notify()
+}
+
+// swapLocked stores c as the current configuration. It returns a function
+// calling the listeners, which must be called after mu is released so that
+// listeners may update the configuration themselves.
+func (s *Store) swapLocked(c *Configurations) func() {
+	old := s.Get()
+	s.current.Store(c)
+	fs := append([]func(old, new *Configurations){}, s.listeners...)
+	return func() {
+		for _, f := range fs {
+			f(old, c)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package config
+
+import (
+	"bytes"
+	"text/template"
+)
+
+// Facts are the host facts the job, grouping and labels of the agent are
+// templated from, {{.Hostname}} is replaced by the hostname.
+type Facts struct {
+	// Hostname is agent.hostname.
+	Hostname string
+	// MachineID is /etc/machine-id on Linux, MachineGuid on Windows.
+	MachineID string
+	// Name is agent.name.
+	Name string
+	// AgentID is the ID given to the agent when it registered.
+	AgentID string
+	// ProjectID is authserver.project.
+	ProjectID string
+	// OS is the operating system, linux or windows.
+	OS string
+}
+
+// Render executes the template s with f.
+func Render(s string, f Facts) (string, error) {
+	t, err := template.New("").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, f); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// RenderLabels executes the template of every label of ls with f. Labels
+// rendered empty are left out.
+func RenderLabels(ls map[string]string, f Facts) (map[string]string, error) {
+	out := make(map[string]string, len(ls))
+	for name, s := range ls {
+		v, err := Render(s, f)
+		if err != nil {
+			return nil, err
+		}
+		if v != "" {
+			out[name] = v
+		}
+	}
+	return out, nil
+}
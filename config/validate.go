@@ -0,0 +1,367 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// Limits of pushgw.waitduration, in seconds.
+const (
+	MinWaitDuration = 1
+	MaxWaitDuration = 3600
+)
+
+// projectIDRegexp matches a UUID, with or without dashes.
+var projectIDRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}$`)
+
+// labelNameRegexp matches a valid Prometheus label name.
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// FieldError is a problem with the value of one configuration key.
+type FieldError struct {
+	// Field is the path of the key, such as pushgw.url.
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError lists every problem found in a configuration file.
+type ValidationError struct {
+	File     string
+	Problems []*FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		msgs = append(msgs, p.Error())
+	}
+	return fmt.Sprintf("invalid configuration in %s: %s", e.File, strings.Join(msgs, "; "))
+}
+
+// Validate checks every configuration key of c. It returns a
+// *ValidationError listing all problems found, or nil if c is usable.
+func (c *Configurations) Validate() error {
+	e := &ValidationError{File: c.file}
+	add := func(field, format string, args ...interface{}) {
+		e.Problems = append(e.Problems, &FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// The API is only used to authenticate pushes.
+	if c.PushGW.Enabled {
+		c.validateAuthServer(add)
+	}
+
+	if !c.PushGW.Enabled {
+		if c.Web.ListenAddress == "" {
+			add("pushgw.enabled", "must be true unless web.listen-address is set")
+		}
+	} else if c.PushGW.URL == "" {
+		add("pushgw.url", "is required")
+	} else {
+		u := c.PushGW.URL
+		// The push gateway accepts host:port and adds http:// itself.
+		if !strings.Contains(u, "://") {
+			u = "http://" + u
+		}
+		if err := checkURL(u); err != nil {
+			add("pushgw.url", "%q %s", c.PushGW.URL, err)
+		}
+	}
+	if c.PushGW.Job == "" {
+		add("pushgw.job", "is required")
+	} else if err := checkTemplate(c.PushGW.Job); err != nil {
+		add("pushgw.job", "%s", err)
+	}
+	checkLabels("pushgw.grouping", c.PushGW.Grouping, add)
+	checkLabels("agent.labels", c.Agent.Labels, add)
+	if c.PushGW.WaitDuration < MinWaitDuration || c.PushGW.WaitDuration > MaxWaitDuration {
+		add("pushgw.waitduration", "must be between %d and %d seconds, got %d",
+			MinWaitDuration, MaxWaitDuration, c.PushGW.WaitDuration)
+	}
+	if c.PushGW.ShutdownTimeout < 0 {
+		add("pushgw.shutdowntimeout", "must not be negative, got %d", c.PushGW.ShutdownTimeout)
+	}
+
+	if c.Web.ListenAddress != "" {
+		if _, _, err := net.SplitHostPort(c.Web.ListenAddress); err != nil {
+			add("web.listen-address", "%s", err)
+		}
+		if !strings.HasPrefix(c.Web.TelemetryPath, "/") {
+			add("web.telemetry-path", "must start with /, got %q", c.Web.TelemetryPath)
+		}
+		if (c.Web.TLSCertFile == "") != (c.Web.TLSKeyFile == "") {
+			add("web.tls-cert-file", "must be set together with web.tls-key-file")
+		}
+		for _, f := range []struct{ field, name string }{
+			{"web.tls-cert-file", c.Web.TLSCertFile},
+			{"web.tls-key-file", c.Web.TLSKeyFile},
+		} {
+			if f.name == "" {
+				continue
+			}
+			if _, err := os.Stat(f.name); err != nil {
+				add(f.field, "%s", err)
+			}
+		}
+		if (c.Web.BasicAuthUsername == "") != (c.Web.BasicAuthPassword == "") {
+			add("web.basic-auth-username", "must be set together with web.basic-auth-password")
+		}
+	}
+
+	for i, m := range c.Devices.Metrics {
+		if _, err := regexp.Compile(m); err != nil {
+			add(fmt.Sprintf("devices.metrics[%d]", i), "%s", err)
+		}
+	}
+
+	for i, r := range c.Relabel.Rules {
+		field := fmt.Sprintf("relabel.rules[%d]", i)
+		if _, err := regexp.Compile("^(?:" + r.Regex + ")$"); err != nil {
+			add(field+".regex", "%s", err)
+		}
+		switch r.Action {
+		case RelabelKeep, RelabelDrop, RelabelLabelDrop, RelabelLabelKeep:
+		case RelabelReplace, RelabelHashMod:
+			if !labelNameRegexp.MatchString(r.TargetLabel) || strings.HasPrefix(r.TargetLabel, "__") {
+				add(field+".target_label", "%q is not a valid label name", r.TargetLabel)
+			}
+			if r.Action == RelabelHashMod && r.Modulus == 0 {
+				add(field+".modulus", "is required for hashmod")
+			}
+		default:
+			add(field+".action", "must be keep, drop, replace, hashmod, labeldrop or labelkeep, got %q", r.Action)
+		}
+		if len(r.SourceLabels) == 0 && (r.Action == RelabelReplace || r.Action == RelabelHashMod) {
+			add(field+".source_labels", "is required for %s", r.Action)
+		}
+	}
+	for name := range c.Relabel.StaticLabels {
+		if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") {
+			add("relabel.static_labels", "%q is not a valid label name", name)
+		}
+	}
+
+	if c.Metadata.Enabled {
+		if c.Metadata.URL == "" && c.Metadata.ConfigDrive == "" {
+			add("metadata.url", "is required unless metadata.config_drive is set")
+		} else if c.Metadata.URL != "" {
+			if err := checkURL(c.Metadata.URL); err != nil {
+				add("metadata.url", "%q %s", c.Metadata.URL, err)
+			}
+		}
+		if c.Metadata.Timeout <= 0 {
+			add("metadata.timeout", "must be positive, got %d", c.Metadata.Timeout)
+		}
+		if c.Metadata.Refresh <= 0 {
+			add("metadata.refresh", "must be positive, got %d", c.Metadata.Refresh)
+		}
+	}
+	for _, l := range []struct {
+		field  string
+		labels map[string]string
+	}{
+		{"metadata.grouping", c.Metadata.Grouping},
+		{"metadata.labels", c.Metadata.Labels},
+	} {
+		for name, field := range l.labels {
+			if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") || name == "job" {
+				add(l.field, "%q is not a valid label name", name)
+			}
+			if field == "" {
+				add(l.field+"."+name, "has no metadata field")
+			}
+		}
+	}
+
+	// Pushes of metrics with a label of the grouping key are rejected.
+	if c.PushGW.Enabled {
+		grouping := map[string]bool{}
+		for name := range c.PushGW.Grouping {
+			grouping[name] = true
+		}
+		labels := map[string]map[string]string{
+			"agent.labels":          c.Agent.Labels,
+			"relabel.static_labels": c.Relabel.StaticLabels,
+		}
+		if c.Metadata.Enabled {
+			for name := range c.Metadata.Grouping {
+				grouping[name] = true
+			}
+			labels["metadata.labels"] = c.Metadata.Labels
+		}
+		for field, ls := range labels {
+			for name := range ls {
+				if grouping[name] {
+					add(field, "%q is a grouping label, in pushgw.grouping or metadata.grouping", name)
+				}
+			}
+		}
+	}
+
+	if c.Status.Address != "" {
+		if err := checkStatusAddress(c.Status.Address); err != nil {
+			add("status.address", "%s", err)
+		}
+	}
+
+	if c.HTTP.ProxyURL != "" {
+		if u, err := url.Parse(c.HTTP.ProxyURL); err != nil || u.Host == "" {
+			add("http.proxy_url", "is not a valid URL")
+		} else if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" {
+			add("http.proxy_url", "must use http, https or socks5")
+		}
+	}
+	for _, f := range []struct{ field, name string }{
+		{"http.ca_file", c.HTTP.CAFile},
+		{"http.cert_file", c.HTTP.CertFile},
+		{"http.key_file", c.HTTP.KeyFile},
+	} {
+		if f.name == "" {
+			continue
+		}
+		if _, err := os.Stat(f.name); err != nil {
+			add(f.field, "%s", err)
+		}
+	}
+	if (c.HTTP.CertFile == "") != (c.HTTP.KeyFile == "") {
+		add("http.cert_file", "must be set together with http.key_file")
+	}
+	switch c.HTTP.MinTLSVersion {
+	case "", "1.0", "1.1", "1.2", "1.3":
+	default:
+		add("http.min_tls_version", "must be 1.0, 1.1, 1.2 or 1.3, got %q", c.HTTP.MinTLSVersion)
+	}
+
+	if c.Retry.InitialInterval < 0 {
+		add("retry.initialinterval", "must not be negative, got %d", c.Retry.InitialInterval)
+	}
+	if c.Retry.MaxInterval < c.Retry.InitialInterval {
+		add("retry.maxinterval", "must not be less than retry.initialinterval, got %d", c.Retry.MaxInterval)
+	}
+	if c.Retry.MaxElapsedTime < 0 {
+		add("retry.maxelapsedtime", "must not be negative, got %d", c.Retry.MaxElapsedTime)
+	}
+
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
+
+// validateAuthServer checks the authserver section of c, with add reporting
+// problems.
+func (c *Configurations) validateAuthServer(add func(field, format string, args ...interface{})) {
+	if c.AuthServer.DefaultEndpoint == "" {
+		add("authserver.defaultendpoint", "is required")
+	} else if err := checkURL(c.AuthServer.DefaultEndpoint); err != nil {
+		add("authserver.defaultendpoint", "%q %s", c.AuthServer.DefaultEndpoint, err)
+	}
+	// Secrets given by the credential helper are only known when it runs.
+	if c.AuthServer.CredentialHelper == "" {
+		if c.AuthServer.Secret == "" && c.AuthServer.SecretFile == "" {
+			add("authserver.secret", "is required, or authserver.secret_file or authserver.credential_helper")
+		}
+		if c.AuthServer.SecretID == "" && c.AuthServer.SecretIDFile == "" {
+			add("authserver.secretid", "is required, or authserver.secretid_file or authserver.credential_helper")
+		}
+	} else if args := strings.Fields(c.AuthServer.CredentialHelper); len(args) == 0 {
+		add("authserver.credential_helper", "is empty")
+	} else if _, err := exec.LookPath(args[0]); err != nil {
+		add("authserver.credential_helper", "%s", err)
+	}
+	if c.AuthServer.SecretFile != "" {
+		if _, err := os.Stat(c.AuthServer.SecretFile); err != nil {
+			add("authserver.secret_file", "%s", err)
+		}
+	}
+	if c.AuthServer.SecretIDFile != "" {
+		if _, err := os.Stat(c.AuthServer.SecretIDFile); err != nil {
+			add("authserver.secretid_file", "%s", err)
+		}
+	}
+	if c.AuthServer.Project == "" {
+		add("authserver.project", "is required")
+	} else if !projectIDRegexp.MatchString(c.AuthServer.Project) {
+		add("authserver.project", "%q is not a valid project ID", c.AuthServer.Project)
+	}
+}
+
+// checkLabels checks the names and the templates of labels, with add
+// reporting problems under field.
+func checkLabels(field string, labels map[string]string, add func(field, format string, args ...interface{})) {
+	for name, s := range labels {
+		if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") || name == "job" {
+			add(field, "%q is not a valid label name", name)
+		}
+		if err := checkTemplate(s); err != nil {
+			add(field+"."+name, "%s", err)
+		}
+	}
+}
+
+// checkTemplate reports whether s is a valid template of Facts.
+func checkTemplate(s string) error {
+	_, err := Render(s, Facts{})
+	return err
+}
+
+// checkURL reports whether s is an absolute http or https URL.
+func checkURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return errors.New("is not a valid URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("must use http or https")
+	}
+	if u.Host == "" {
+		return errors.New("has no host")
+	}
+	return nil
+}
+
+// checkStatusAddress reports whether s is a loopback host:port or a unix
+// socket, the status of the agent is never exposed to the network.
+func checkStatusAddress(s string) error {
+	if strings.HasPrefix(s, "unix:") {
+		if strings.TrimPrefix(s, "unix:") == "" {
+			return errors.New("has no socket path")
+		}
+		return nil
+	}
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("%q is not a loopback address or a unix socket", host)
+	}
+	return nil
+}
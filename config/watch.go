@@ -0,0 +1,90 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package config
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	prol "github.com/prometheus/common/log"
+)
+
+// reloadDelay groups the burst of events an editor makes when saving a file
+// into a single reload.
+const reloadDelay = 500 * time.Millisecond
+
+// Watch reloads the configuration every time the configuration file changes,
+// until done is closed. The directory is watched instead of the file itself
+// so that atomic saves and replaced ConfigMap mounts are seen too.
+func (s *Store) Watch(done <-chan struct{}) error {
+	file := s.Get().File()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		var (
+			timer   *time.Timer
+			reload  <-chan time.Time
+			current = filepath.Clean(file)
+			real, _ = filepath.EvalSymlinks(file)
+		)
+		for {
+			select {
+			case <-done:
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				nowReal, _ := filepath.EvalSymlinks(file)
+				if filepath.Clean(event.Name) != current && nowReal == real {
+					continue
+				}
+				real = nowReal
+				if timer == nil {
+					timer = time.NewTimer(reloadDelay)
+				} else {
+					timer.Reset(reloadDelay)
+				}
+				reload = timer.C
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				prol.Errorf("error watching configuration file: %s", err)
+			case <-reload:
+				reload = nil
+				prol.Infof("configuration file %s changed, reloading", file)
+				if err := s.Reload(); err != nil {
+					prol.Errorf("failed to reload configuration, keep running with the old one: %s", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,83 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/bizflycloud/bizfly-agent/collectors"
+	"github.com/bizflycloud/bizfly-agent/config"
+	"github.com/bizflycloud/bizfly-agent/state"
+)
+
+// checkConfig implements `bizfly-agent config check`. It prints every
+// problem found in the configuration and returns the exit code.
+func checkConfig() int {
+	cfg, err := loadConfig()
+	if err == nil {
+		err = collectors.Check(cfg)
+	}
+	if err != nil {
+		var verr *config.ValidationError
+		if !errors.As(err, &verr) {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "%s is invalid:\n", verr.File)
+		for _, p := range verr.Problems {
+			fmt.Fprintf(os.Stderr, "  %s\n", p)
+		}
+		return 1
+	}
+	fmt.Printf("%s is valid\n", cfg.File())
+	return 0
+}
+
+// showConfig implements `bizfly-agent config show`. It prints the effective
+// value of every configuration key and where it comes from.
+func showConfig() int {
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	// Show the registered agent ID saved in the state file too.
+	if st, err := state.Open(cfg.Agent.StateFile); err == nil {
+		store := config.NewStore(cfg)
+		store.SetAgentID(st.Get().AgentID)
+		cfg = store.Get()
+	}
+	fmt.Printf("# %s\n", cfg.File())
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+	for _, s := range cfg.Settings() {
+		value := s.Value
+		if s.Secret && value != "" {
+			value = "<redacted>"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.Key, value, s.Source)
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	return 0
+}
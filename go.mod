@@ -3,6 +3,7 @@ module github.com/bizflycloud/bizfly-agent
 go 1.14
 
 require (
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/go-kit/kit v0.10.0
 	github.com/mindprince/gonvml v0.0.0-20190828220739-9ebdce4bb989 // indirect
 	github.com/prometheus/client_golang v1.7.1
@@ -11,7 +12,10 @@ require (
 	github.com/prometheus/node_exporter v1.0.1
 	github.com/shirou/gopsutil v3.20.10+incompatible
 	github.com/spf13/viper v1.7.0
+	golang.org/x/net v0.0.0-20201202161906-c7110b5ffcbb
+	golang.org/x/sys v0.0.0-20201202213521-69691e467435
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 replace github.com/prometheus/node_exporter => github.com/bizflycloud/node_exporter v1.0.7
@@ -0,0 +1,77 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+// Package identity reads the facts identifying the host the agent runs on.
+package identity
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// errNoMachineID is returned when the host has no machine ID.
+var errNoMachineID = errors.New("no machine ID found")
+
+// MachineID returns the ID of the host, such as /etc/machine-id on Linux. It
+// is the same across reboots and hostname changes.
+func MachineID() (string, error) {
+	return machineID()
+}
+
+// Identity identifies the host the agent runs on.
+type Identity struct {
+	// MachineID is the ID of the operating system installation, copied
+	// along with the disk when an image is cloned.
+	MachineID string `json:"machine_id,omitempty"`
+	// ProductUUID is the DMI product UUID of the virtual machine, which
+	// differs between clones.
+	ProductUUID string `json:"product_uuid,omitempty"`
+	// Fingerprint is derived from MachineID and ProductUUID, so that it can
+	// be sent to the server without disclosing them.
+	Fingerprint string `json:"fingerprint"`
+}
+
+// Read returns the identity of the host. It fails only if the host has
+// neither a machine ID nor a product UUID.
+func Read() (*Identity, error) {
+	mid, err := machineID()
+	uuid := productUUID()
+	if mid == "" && uuid == "" {
+		return nil, err
+	}
+	return &Identity{MachineID: mid, ProductUUID: uuid, Fingerprint: fingerprint(mid, uuid)}, nil
+}
+
+func fingerprint(machineID, productUUID string) string {
+	h := sha256.Sum256([]byte("bizfly-agent\x00" + machineID + "\x00" + productUUID))
+	return hex.EncodeToString(h[:16])
+}
+
+// SameHost reports whether id and other were read on the same host. Hosts
+// differ if they have different machine IDs, or a different product UUID
+// when an image was cloned with its machine ID.
+func (id Identity) SameHost(other Identity) bool {
+	if id.MachineID != "" && other.MachineID != "" && id.MachineID != other.MachineID {
+		return false
+	}
+	if id.ProductUUID != "" && other.ProductUUID != "" && !strings.EqualFold(id.ProductUUID, other.ProductUUID) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package identity
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+// machineIDFiles are read in order for the machine ID.
+var machineIDFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+func machineID() (string, error) {
+	for _, f := range machineIDFiles {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		if id := strings.TrimSpace(string(b)); id != "" {
+			return id, nil
+		}
+	}
+	return "", errNoMachineID
+}
+
+// productUUIDFile is only readable by root.
+const productUUIDFile = "/sys/class/dmi/id/product_uuid"
+
+func productUUID() string {
+	b, err := ioutil.ReadFile(productUUIDFile)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(string(b)))
+}
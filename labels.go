@@ -0,0 +1,107 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	prol "github.com/prometheus/common/log"
+
+	"github.com/bizflycloud/bizfly-agent/config"
+	"github.com/bizflycloud/bizfly-agent/identity"
+	"github.com/bizflycloud/bizfly-agent/metadata"
+)
+
+var (
+	machineIDOnce sync.Once
+	machineID     string
+)
+
+// hostFacts returns the facts the job, grouping and labels of cfg are
+// templated from.
+func hostFacts(cfg *config.Configurations) config.Facts {
+	machineIDOnce.Do(func() {
+		var err error
+		if machineID, err = identity.MachineID(); err != nil {
+			prol.Warnf("failed to read machine ID: %s", err)
+		}
+	})
+	return config.Facts{
+		Hostname:  cfg.Agent.Hostname,
+		MachineID: machineID,
+		Name:      cfg.Agent.Name,
+		AgentID:   cfg.Agent.ID,
+		ProjectID: cfg.AuthServer.Project,
+		OS:        runtime.GOOS,
+	}
+}
+
+// agentLabels returns the labels added to every metric: agent.labels, then
+// the metadata labels the agent labels don't have.
+func agentLabels(cfg *config.Configurations, md *metadata.Provider) map[string]string {
+	ls, err := config.RenderLabels(cfg.Agent.Labels, hostFacts(cfg))
+	if err != nil {
+		prol.Errorf("failed to render agent.labels: %s", err)
+		ls = map[string]string{}
+	}
+	for name, value := range md.Labels() {
+		if _, ok := ls[name]; !ok {
+			ls[name] = value
+		}
+	}
+	return ls
+}
+
+// withLabels returns a gatherer adding the labels returned by labels to every
+// metric of g that doesn't have them.
+func withLabels(g prometheus.Gatherer, labels func() map[string]string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+		ls := labels()
+		if len(ls) == 0 {
+			return mfs, err
+		}
+		for _, mf := range mfs {
+			for _, m := range mf.Metric {
+				m.Label = addLabels(m.Label, ls)
+			}
+		}
+		return mfs, err
+	})
+}
+
+// addLabels adds ls to labels, unless they are already there, and sorts
+// them by name.
+func addLabels(labels []*dto.LabelPair, ls map[string]string) []*dto.LabelPair {
+	set := make(map[string]bool, len(labels))
+	for _, l := range labels {
+		set[l.GetName()] = true
+	}
+	for name, value := range ls {
+		if !set[name] {
+			name, value := name, value
+			labels = append(labels, &dto.LabelPair{Name: &name, Value: &value})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+	return labels
+}
@@ -18,9 +18,14 @@
 package main
 
 import (
-	"runtime"
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/push"
 	prol "github.com/prometheus/common/log"
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -28,58 +33,320 @@ import (
 	"github.com/bizflycloud/bizfly-agent/client"
 	"github.com/bizflycloud/bizfly-agent/collectors"
 	"github.com/bizflycloud/bizfly-agent/config"
+	"github.com/bizflycloud/bizfly-agent/identity"
+	"github.com/bizflycloud/bizfly-agent/metadata"
+	"github.com/bizflycloud/bizfly-agent/state"
+	"github.com/bizflycloud/bizfly-agent/status"
+	"github.com/bizflycloud/bizfly-agent/web"
 )
 
 var (
 	version   string
 	gitCommit string
+
+	configFile = kingpin.Flag("config.file", "Path to bizfly-agent.yaml, searched in the default locations if not set.").String()
+
+	runCmd         = kingpin.Command("run", "Collect metrics, push them to the push gateway and serve them on web.listen-address.").Default()
+	runDryRun      = runCmd.Flag("dry-run", "Do everything but push to the push gateway, log what would be pushed instead.").Bool()
+	collectCmd     = kingpin.Command("collect", "Print collected metrics, without registering the agent or pushing them.")
+	collectOnce    = collectCmd.Flag("once", "Collect once and exit, instead of every pushgw.waitduration seconds.").Bool()
+	collectOutput  = collectCmd.Flag("output", "Output format: text or json.").Default("text").Enum("text", "json")
+	configCmd      = kingpin.Command("config", "Inspect the agent configuration.")
+	configCheckCmd = configCmd.Command("check", "Validate the configuration file, exit non-zero if it is invalid.")
+	configShowCmd  = configCmd.Command("show", "Print the effective configuration, with secrets redacted.")
+	statusCmd      = kingpin.Command("status", "Show the status of the running agent, exit non-zero unless it is ready.")
 )
 
 func main() {
 	// Show current version
 	if version == "" {
-		version = "BizFly Metrics Agent version: dev"
+		kingpin.Version("BizFly Metrics Agent version: dev")
 	} else {
-		version = "BizFly Metrics Agent version: " + version + ", build: " + gitCommit
+		kingpin.Version("BizFly Metrics Agent version: " + version + ", build: " + gitCommit)
 	}
-	kingpin.Version(version)
 
 	// Do not remove theses lines, prometheus needs them to run.
 	prol.AddFlags(kingpin.CommandLine)
+	config.AddFlags(kingpin.CommandLine)
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	switch kingpin.Parse() {
+	case configCheckCmd.FullCommand():
+		os.Exit(checkConfig())
+	case configShowCmd.FullCommand():
+		os.Exit(showConfig())
+	case collectCmd.FullCommand():
+		os.Exit(collect(*collectOnce, *collectOutput))
+	case statusCmd.FullCommand():
+		os.Exit(showStatus())
+	case runCmd.FullCommand():
+		runAgent()
+	}
+}
+
+// loadConfig loads the configuration from --config.file, or from the default
+// locations.
+func loadConfig() (*config.Configurations, error) {
+	var paths []string
+	if *configFile != "" {
+		paths = append(paths, *configFile)
+	}
+	return config.Load(paths...)
+}
+
+// runAgent runs the agent until it is stopped by a signal.
+func runAgent() {
+	cfg, err := loadConfig()
+	if err == nil {
+		err = collectors.Check(cfg)
+	}
+	if err != nil {
+		prol.Fatalf("failed to load configuration: %s", err)
+	}
+	store := config.NewStore(cfg)
+
+	st, err := state.Open(cfg.Agent.StateFile)
+	if err != nil {
+		prol.Fatalf("failed to read agent state: %s", err)
+	}
 
-	var httpClient = client.NewHTTPClient()
-	if _, err := httpClient.AuthToken(); err != nil {
-		prol.Errorf("failed to get client auth token: %s", err)
+	// ctx is cancelled on SIGINT and SIGTERM.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpClient, err := client.NewHTTPClient(ctx, store, st)
+	if err != nil {
+		prol.Fatalf("failed to create HTTP client: %s", err)
+	}
+	ident, err := identity.Read()
+	if err != nil {
+		prol.Warnf("failed to read host identity, cloned hosts are not detected: %s", err)
+	}
+	if err := httpClient.CheckIdentity(ident); err != nil {
+		prol.Fatalf("%s", err)
 	}
 
-	pushGatewayAddress := config.Config.PushGW.URL
-	waitDuration := config.Config.PushGW.WaitDuration
+	if id := st.Get().AgentID; id != "" {
+		store.SetAgentID(id)
+	} else if id := store.Get().Agent.ID; id != "" {
+		// Agents registered before the state file existed have their ID in
+		// the configuration file.
+		if err := st.Update(func(s *state.State) { s.AgentID = id }); err != nil {
+			prol.Errorf("failed to save agent ID to %s: %s", st.Path(), err)
+		}
+	}
 
-	nc, err := collectors.NewNodeCollector(collectors.DefaultCollectors)
+	nc, err := collectors.NewNodeCollector(cfg)
 	if err != nil {
 		prol.Fatalf("failed to create new collector: %s\n", err.Error())
 	}
+	store.AddCheck(collectors.Check)
+	store.OnChange(func(old, new *config.Configurations) {
+		if reflect.DeepEqual(old.Collectors, new.Collectors) {
+			return
+		}
+		if err := nc.Configure(new.Collectors); err != nil {
+			prol.Errorf("failed to apply the new collectors configuration, keep the old one: %s", err)
+			return
+		}
+		prol.Infoln("collectors reconfigured")
+	})
+	store.OnChange(func(old, new *config.Configurations) {
+		if reflect.DeepEqual(old.Relabel, new.Relabel) {
+			return
+		}
+		if err := nc.SetRelabel(new.Relabel); err != nil {
+			prol.Errorf("failed to apply the new relabel rules, keep the old ones: %s", err)
+		}
+	})
+	store.OnChange(func(old, new *config.Configurations) {
+		if reflect.DeepEqual(old.Devices, new.Devices) {
+			return
+		}
+		if err := nc.SetDeviceMetrics(new.Devices.Metrics); err != nil {
+			prol.Errorf("failed to apply the new device metrics, keep the old ones: %s", err)
+		}
+	})
+
+	md := metadata.New(cfg.Metadata)
+	store.OnChange(func(old, new *config.Configurations) {
+		if !reflect.DeepEqual(old.Metadata, new.Metadata) {
+			md.SetConfig(new.Metadata)
+		}
+	})
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(nc, httpClient)
+	registerSelfMetrics(reg)
+
+	// Agent and metadata labels are added to self metrics too.
+	gatherer := withLabels(reg, func() map[string]string { return agentLabels(store.Get(), md) })
+	p := &pusher{
+		gatherer: gatherer,
+		client:   httpClient,
+		dryRun:   *runDryRun,
+		newPusher: func(g prometheus.Gatherer) (*push.Pusher, error) {
+			cfg := store.Get()
+			f := hostFacts(cfg)
+			job, err := config.Render(cfg.PushGW.Job, f)
+			if err != nil {
+				return nil, err
+			}
+			grouping, err := config.RenderLabels(cfg.PushGW.Grouping, f)
+			if err != nil {
+				return nil, err
+			}
+			// Metadata grouping labels replace the configured ones.
+			mdGrouping, err := md.Grouping()
+			if err != nil {
+				return nil, err
+			}
+			for name, value := range mdGrouping {
+				grouping[name] = value
+			}
+			pusher := push.New(cfg.PushGW.URL, job).Gatherer(g)
+			for name, value := range grouping {
+				pusher = pusher.Grouping(name, value)
+			}
+			return pusher, nil
+		},
+	}
+	p.initMetrics()
+	reg.MustRegister(p)
+
+	reload := make(chan struct{}, 1)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range sigs {
+			if sig == syscall.SIGHUP {
+				select {
+				case reload <- struct{}{}:
+				default:
+				}
+				continue
+			}
+			if ctx.Err() != nil {
+				prol.Warnf("received %s again, exiting now", sig)
+				os.Exit(1)
+			}
+			prol.Infof("received %s, shutting down", sig)
+			timeout := time.Duration(store.Get().PushGW.ShutdownTimeout) * time.Second
+			time.AfterFunc(timeout, func() {
+				prol.Errorf("failed to shut down within %s, exiting now", timeout)
+				os.Exit(1)
+			})
+			cancel()
+		}
+	}()
+
+	httpClient.RefreshInBackground(ctx)
+
+	if err := web.New(store, gatherer).Serve(ctx); err != nil {
+		prol.Fatalf("failed to serve metrics: %s", err)
+	}
+	if addr := cfg.Status.Address; addr != "" {
+		report := statusReporter(store, httpClient, nc, p)
+		if err := status.NewServer(report).Serve(ctx, addr); err != nil {
+			prol.Errorf("failed to serve status on %s: %s", addr, err)
+		}
+	}
+
+	if err := store.Watch(ctx.Done()); err != nil {
+		prol.Warnf("configuration file is not watched, send SIGHUP to reload it: %s", err)
+	}
+
+	// The agent only registers and authenticates to push, in the background
+	// so that metrics are served while the API is unreachable.
+	reportIdentity := func() {
+		if !store.Get().PushGW.Enabled {
+			return
+		}
+		if _, err := httpClient.AuthToken(); err != nil {
+			prol.Errorf("failed to get client auth token: %s", err)
+			return
+		}
+		if err := httpClient.ReportIdentity(); err != nil {
+			prol.Errorf("failed to report agent identity: %s", err)
+		}
+	}
+	go reportIdentity()
+	store.OnChange(func(old, new *config.Configurations) {
+		if old.Agent.Name != new.Agent.Name || old.Agent.Hostname != new.Agent.Hostname ||
+			!old.PushGW.Enabled && new.PushGW.Enabled {
+			go reportIdentity()
+		}
+	})
 
-	pusher := push.New(pushGatewayAddress, "bizfly-agent").
-		Client(httpClient).
-		Grouping("hostname", config.Config.Agent.Hostname).
-		Grouping("instance", config.Config.Agent.Name).
-		Grouping("instance_id", config.Config.Agent.ID).
-		Grouping("project_id", config.Config.AuthServer.Project).
-		Grouping("runtime", runtime.GOOS).
-		Collector(nc)
+	// The first sample is pushed with the instance metadata, if it can be
+	// read within metadata.timeout.
+	md.Refresh()
+	run(ctx, store, p, reload)
+}
 
-	if err := pusher.Push(); err != nil {
+// run pushes a sample every pushgw.waitduration seconds until ctx is done,
+// then shuts down. Nothing is pushed while pushgw.enabled is false.
+func run(ctx context.Context, store *config.Store, p *pusher, reload <-chan struct{}) {
+	pushEnabled := func() bool { return store.Get().PushGW.Enabled }
+	if !pushEnabled() {
+		prol.Infoln("pushing to push gateway is disabled")
+	} else if err := p.Push(); err != nil {
 		prol.Errorf("failed to make initial push to push gateway: %s", err.Error())
 	}
+
+	// Apply a new push interval right away instead of after the current one.
+	changed := make(chan struct{}, 1)
+	store.OnChange(func(old, new *config.Configurations) {
+		if old.PushGW.WaitDuration != new.PushGW.WaitDuration {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	})
+
+	timer := time.NewTimer(time.Second * time.Duration(store.Get().PushGW.WaitDuration))
+	defer timer.Stop()
 	for {
-		time.Sleep(time.Second * time.Duration(waitDuration))
-		if err := pusher.Push(); err != nil {
-			prol.Errorf("failed to push data was collected to push gateway: %s\n", err.Error())
-		} else {
-			prol.Debugln("pushing data was collected to push gateway")
+		select {
+		case <-ctx.Done():
+			// The current collection, if any, has finished at this point.
+			if pushEnabled() {
+				shutdown(store, p)
+			}
+			prol.Infoln("bizfly-agent stopped")
+			return
+		case <-reload:
+			prol.Infoln("reloading configuration")
+			if err := store.Reload(); err != nil {
+				prol.Errorf("failed to reload configuration, keep running with the old one: %s", err)
+			}
+		case <-changed:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(time.Second * time.Duration(store.Get().PushGW.WaitDuration))
+		case <-timer.C:
+			if pushEnabled() {
+				if err := p.Push(); err != nil {
+					prol.Errorf("failed to push data was collected to push gateway: %s\n", err.Error())
+				} else {
+					prol.Debugln("pushing data was collected to push gateway")
+				}
+			}
+			timer.Reset(time.Second * time.Duration(store.Get().PushGW.WaitDuration))
+		}
+	}
+}
+
+// shutdown makes the final push and, if configured, deletes the metrics
+// group from the push gateway.
+func shutdown(store *config.Store, p *pusher) {
+	if err := p.Push(); err != nil {
+		prol.Errorf("failed to make final push to push gateway: %s", err.Error())
+	}
+	if store.Get().PushGW.DeleteOnShutdown {
+		if err := p.Delete(); err != nil {
+			prol.Errorf("failed to delete metrics from push gateway: %s", err.Error())
 		}
 	}
 }
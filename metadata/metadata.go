@@ -0,0 +1,223 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+// Package metadata reads the OpenStack metadata of the cloud instance the
+// agent runs on, from the metadata service or a config drive, and turns it
+// into grouping and metric labels.
+package metadata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	prol "github.com/prometheus/common/log"
+
+	"github.com/bizflycloud/bizfly-agent/config"
+)
+
+// configDriveFile is the metadata file in a config drive.
+const configDriveFile = "openstack/latest/meta_data.json"
+
+// retryInterval is how long to wait before reading the metadata again after
+// a failure, instead of metadata.refresh.
+const retryInterval = time.Minute
+
+// ErrNotRead is returned by Grouping until the instance metadata is read.
+var ErrNotRead = errors.New("instance metadata is not read yet")
+
+// Provider caches the instance metadata. Its methods are safe for
+// concurrent use.
+type Provider struct {
+	mu   sync.Mutex
+	cfg  config.Metadata
+	data map[string]interface{}
+	// next is when the metadata is read again.
+	next time.Time
+	// refreshing is set while the metadata is read.
+	refreshing bool
+	// generation is incremented when the metadata comes from another place,
+	// reads started before are discarded.
+	generation int
+}
+
+// New returns a Provider reading the metadata as configured by cfg. Nothing
+// is read until Refresh is called or labels are asked for.
+func New(cfg config.Metadata) *Provider {
+	return &Provider{cfg: cfg}
+}
+
+// SetConfig replaces the configuration of p. The metadata is read again if
+// it comes from another place.
+func (p *Provider) SetConfig(cfg config.Metadata) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cfg.URL != p.cfg.URL || cfg.ConfigDrive != p.cfg.ConfigDrive || cfg.Enabled != p.cfg.Enabled {
+		p.data, p.next = nil, time.Time{}
+		p.generation++
+	}
+	p.cfg = cfg
+}
+
+// Grouping returns the grouping labels, nil if metadata is disabled. It
+// returns ErrNotRead if grouping labels are configured but the metadata
+// hasn't been read yet, so that samples aren't pushed to another group.
+func (p *Provider) Grouping() (map[string]string, error) {
+	ls, ok := p.labels(func(cfg config.Metadata) map[string]string { return cfg.Grouping })
+	if !ok {
+		return nil, ErrNotRead
+	}
+	return ls, nil
+}
+
+// Labels returns the labels added to every metric, nil if metadata is
+// disabled or hasn't been read yet.
+func (p *Provider) Labels() map[string]string {
+	ls, _ := p.labels(func(cfg config.Metadata) map[string]string { return cfg.Labels })
+	return ls
+}
+
+// labels resolves the label names to metadata fields returned by fields,
+// from the cached metadata. Labels whose field isn't in the metadata are
+// left out. It reports false if there are labels to resolve but the
+// metadata hasn't been read yet. The metadata is refreshed in the
+// background if it is too old.
+func (p *Provider) labels(fields func(config.Metadata) map[string]string) (map[string]string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.cfg.Enabled || len(fields(p.cfg)) == 0 {
+		return nil, true
+	}
+	if !p.refreshing && !time.Now().Before(p.next) {
+		go p.Refresh()
+	}
+	if p.data == nil {
+		return nil, false
+	}
+	ls := make(map[string]string)
+	for name, field := range fields(p.cfg) {
+		v, ok := lookup(p.data, field)
+		if !ok {
+			prol.Debugf("instance metadata has no %s for label %s", field, name)
+			continue
+		}
+		ls[name] = v
+	}
+	return ls, true
+}
+
+// Refresh reads the metadata again if the cached one is too old, and waits
+// for it. Labels are served from the cache meanwhile. The last good metadata
+// is kept if it can't be read.
+func (p *Provider) Refresh() {
+	p.mu.Lock()
+	if !p.cfg.Enabled || p.refreshing || time.Now().Before(p.next) {
+		p.mu.Unlock()
+		return
+	}
+	p.refreshing = true
+	cfg, generation := p.cfg, p.generation
+	p.mu.Unlock()
+
+	data, err := read(cfg)
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refreshing = false
+	if generation != p.generation {
+		return
+	}
+	if err != nil {
+		prol.Errorf("failed to read instance metadata: %s", err)
+		p.next = now.Add(retryInterval)
+		return
+	}
+	p.data = data
+	p.next = now.Add(time.Duration(cfg.Refresh) * time.Second)
+}
+
+// read reads meta_data.json from the config drive, or from the metadata
+// service if there is no config drive.
+func read(cfg config.Metadata) (map[string]interface{}, error) {
+	if cfg.ConfigDrive != "" {
+		b, err := ioutil.ReadFile(filepath.Join(cfg.ConfigDrive, configDriveFile))
+		if err == nil {
+			return decode(b)
+		}
+		if cfg.URL == "" {
+			return nil, err
+		}
+		prol.Debugf("failed to read config drive, using the metadata service: %s", err)
+	}
+
+	// The metadata service is link-local, it is never reached through a
+	// proxy.
+	c := &http.Client{
+		Transport: &http.Transport{},
+		Timeout:   time.Duration(cfg.Timeout) * time.Second,
+	}
+	resp, err := c.Get(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", cfg.URL, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return decode(b)
+}
+
+func decode(b []byte) (map[string]interface{}, error) {
+	var data map[string]interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, fmt.Errorf("invalid metadata: %s", err)
+	}
+	return data, nil
+}
+
+// lookup returns the value of field in data. Fields of nested objects are
+// separated by dots, meta.role is the role key of the user metadata.
+func lookup(data map[string]interface{}, field string) (string, bool) {
+	var v interface{} = data
+	for _, k := range strings.Split(field, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if v, ok = m[k]; !ok {
+			return "", false
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		return v, v != ""
+	case float64, bool:
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
@@ -0,0 +1,315 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package metadata
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bizflycloud/bizfly-agent/config"
+)
+
+// metadataServer is a metadata service returning body, or failing while
+// fail is set.
+type metadataServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	body     string
+	fail     bool
+	requests int
+}
+
+func newMetadataServer(t *testing.T, body string) *metadataServer {
+	s := &metadataServer{body: body}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests++
+		if s.fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(s.body))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *metadataServer) set(body string, fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.body, s.fail = body, fail
+}
+
+func (s *metadataServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// newConfigDrive returns a config drive holding body as its meta_data.json.
+func newConfigDrive(t *testing.T, body string) string {
+	dir, err := ioutil.TempDir("", "config-drive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	file := filepath.Join(dir, configDriveFile)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func testConfig(url, configDrive string) config.Metadata {
+	return config.Metadata{
+		Enabled:     true,
+		URL:         url,
+		ConfigDrive: configDrive,
+		Timeout:     2,
+		Refresh:     3600,
+		Grouping:    map[string]string{"server_id": "uuid"},
+		Labels:      map[string]string{"role": "meta.role"},
+	}
+}
+
+func TestConfigDriveIsPreferred(t *testing.T) {
+	srv := newMetadataServer(t, `{"uuid": "from-service"}`)
+	drive := newConfigDrive(t, `{"uuid": "from-drive"}`)
+
+	p := New(testConfig(srv.URL, drive))
+	p.Refresh()
+	want := map[string]string{"server_id": "from-drive"}
+	if got, err := p.Grouping(); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Grouping() = %v, %v, want %v", got, err, want)
+	}
+	if n := srv.count(); n != 0 {
+		t.Errorf("metadata service got %d requests, want none", n)
+	}
+}
+
+func TestFallbackToMetadataService(t *testing.T) {
+	srv := newMetadataServer(t, `{"uuid": "from-service"}`)
+	// The config drive is not mounted.
+	drive := filepath.Join(newConfigDrive(t, "{}"), "missing")
+
+	p := New(testConfig(srv.URL, drive))
+	p.Refresh()
+	want := map[string]string{"server_id": "from-service"}
+	if got, err := p.Grouping(); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Grouping() = %v, %v, want %v", got, err, want)
+	}
+}
+
+func TestConfigDriveWithoutURL(t *testing.T) {
+	drive := filepath.Join(newConfigDrive(t, "{}"), "missing")
+
+	p := New(testConfig("", drive))
+	p.Refresh()
+	if got, err := p.Grouping(); err != ErrNotRead {
+		t.Errorf("Grouping() = %v, %v, want %v", got, err, ErrNotRead)
+	}
+}
+
+// expire makes the metadata of p due for a refresh.
+func expire(p *Provider) {
+	p.mu.Lock()
+	p.next = time.Time{}
+	p.mu.Unlock()
+}
+
+func TestRefresh(t *testing.T) {
+	srv := newMetadataServer(t, `{"uuid": "first"}`)
+	p := New(testConfig(srv.URL, ""))
+
+	p.Refresh()
+	want := map[string]string{"server_id": "first"}
+	if got, err := p.Grouping(); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("Grouping() = %v, %v, want %v", got, err, want)
+	}
+
+	// The metadata is cached until metadata.refresh.
+	srv.set(`{"uuid": "second"}`, false)
+	p.Refresh()
+	if got, _ := p.Grouping(); !reflect.DeepEqual(got, want) {
+		t.Errorf("cached Grouping() = %v, want %v", got, want)
+	}
+	if n := srv.count(); n != 1 {
+		t.Errorf("metadata service got %d requests, want 1", n)
+	}
+
+	// The last good metadata is kept if it can't be read again, and read
+	// again after retryInterval instead of metadata.refresh.
+	srv.set("", true)
+	expire(p)
+	before := time.Now()
+	p.Refresh()
+	if got, _ := p.Grouping(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Grouping() after failure = %v, want %v", got, want)
+	}
+	p.mu.Lock()
+	next := p.next
+	p.mu.Unlock()
+	if next.Before(before.Add(retryInterval)) || next.After(time.Now().Add(retryInterval)) {
+		t.Errorf("next read at %s, want %s after the failure", next, retryInterval)
+	}
+
+	srv.set(`{"uuid": "second"}`, false)
+	expire(p)
+	p.Refresh()
+	want = map[string]string{"server_id": "second"}
+	if got, _ := p.Grouping(); !reflect.DeepEqual(got, want) {
+		t.Errorf("refreshed Grouping() = %v, want %v", got, want)
+	}
+}
+
+func TestGroupingBeforeRead(t *testing.T) {
+	srv := newMetadataServer(t, `{"uuid": "u1"}`)
+	p := New(testConfig(srv.URL, ""))
+
+	// Asking for labels reads the metadata in the background.
+	if got, err := p.Grouping(); err != ErrNotRead {
+		t.Fatalf("Grouping() = %v, %v, want %v", got, err, ErrNotRead)
+	}
+	want := map[string]string{"server_id": "u1"}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := p.Grouping()
+		if err == nil {
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Grouping() = %v, want %v", got, want)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("metadata not read in the background: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLabelsDontWaitForMetadata(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		_, _ = w.Write([]byte(`{"meta": {"role": "db"}}`))
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	p := New(testConfig(srv.URL, ""))
+	go p.Refresh()
+
+	done := make(chan map[string]string)
+	go func() { done <- p.Labels() }()
+	select {
+	case got := <-done:
+		if got != nil {
+			t.Errorf("Labels() = %v before the metadata is read, want nil", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Labels() waits for the metadata service")
+	}
+}
+
+func TestSetConfigRereads(t *testing.T) {
+	first := newMetadataServer(t, `{"uuid": "first"}`)
+	second := newMetadataServer(t, `{"uuid": "second"}`)
+	p := New(testConfig(first.URL, ""))
+	p.Refresh()
+
+	p.SetConfig(testConfig(second.URL, ""))
+	p.Refresh()
+	want := map[string]string{"server_id": "second"}
+	if got, err := p.Grouping(); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Grouping() = %v, %v, want %v", got, err, want)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	srv := newMetadataServer(t, `{"uuid": "u1", "meta": {"role": "db"}}`)
+	p := New(testConfig(srv.URL, ""))
+	p.Refresh()
+
+	want := map[string]string{"role": "db"}
+	if got := p.Labels(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Labels() = %v, want %v", got, want)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	srv := newMetadataServer(t, `{"uuid": "u1"}`)
+	cfg := testConfig(srv.URL, "")
+	cfg.Enabled = false
+
+	p := New(cfg)
+	p.Refresh()
+	if got, err := p.Grouping(); got != nil || err != nil {
+		t.Errorf("Grouping() = %v, %v, want nil", got, err)
+	}
+	if n := srv.count(); n != 0 {
+		t.Errorf("metadata service got %d requests, want none", n)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	data, err := decode([]byte(`{
+		"uuid": "u1",
+		"availability_zone": "HN1",
+		"launch_index": 0,
+		"empty": "",
+		"meta": {"role": "db", "nested": {"tier": "gold"}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		field string
+		want  string
+		ok    bool
+	}{
+		{"uuid", "u1", true},
+		{"availability_zone", "HN1", true},
+		{"launch_index", "0", true},
+		{"meta.role", "db", true},
+		{"meta.nested.tier", "gold", true},
+		{"empty", "", false},
+		{"missing", "", false},
+		{"meta", "", false},
+		{"meta.missing", "", false},
+		{"uuid.role", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := lookup(data, tt.field)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("lookup(%q) = %q, %v, want %q, %v", tt.field, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	prol "github.com/prometheus/common/log"
+)
+
+// pusher gathers one sample per call to Push and sends it to the push
+// gateway. A sample that can't be pushed is dropped: the push gateway keeps
+// only the last sample of a group and rejects samples with timestamps, so
+// there is no history to push later.
+type pusher struct {
+	gatherer  prometheus.Gatherer
+	client    push.HTTPDoer
+	newPusher func(g prometheus.Gatherer) (*push.Pusher, error)
+	// dryRun logs samples instead of pushing them.
+	dryRun bool
+
+	duration    prometheus.Histogram
+	results     *prometheus.CounterVec
+	lastSuccess prometheus.Gauge
+
+	// mu guards the outcome of the last push.
+	mu   sync.Mutex
+	last pushResult
+}
+
+// pushResult is the outcome of the last push.
+type pushResult struct {
+	attempt time.Time
+	success time.Time
+	err     error
+}
+
+// initMetrics sets up the metrics p reports about its pushes. It must be
+// called before p is used.
+func (p *pusher) initMetrics() {
+	p.duration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bizfly_agent_push_duration_seconds",
+		Help:    "Duration of pushes to the push gateway.",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	})
+	p.results = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bizfly_agent_pushes_total",
+		Help: "Number of pushes to the push gateway, by result.",
+	}, []string{"result"})
+	p.results.WithLabelValues("success")
+	p.results.WithLabelValues("failure")
+	p.lastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bizfly_agent_last_push_success_timestamp_seconds",
+		Help: "Time of the last successful push to the push gateway.",
+	})
+}
+
+// Describe implements prometheus.Collector.
+func (p *pusher) Describe(ch chan<- *prometheus.Desc) {
+	p.duration.Describe(ch)
+	p.results.Describe(ch)
+	p.lastSuccess.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (p *pusher) Collect(ch chan<- prometheus.Metric) {
+	p.duration.Collect(ch)
+	p.results.Collect(ch)
+	p.lastSuccess.Collect(ch)
+}
+
+// Push gathers and pushes a new sample.
+func (p *pusher) Push() (err error) {
+	now := time.Now()
+	defer func() {
+		p.duration.Observe(time.Since(now).Seconds())
+		p.mu.Lock()
+		p.last.attempt, p.last.err = now, err
+		if err == nil {
+			p.last.success = now
+		}
+		p.mu.Unlock()
+		if err != nil {
+			p.results.WithLabelValues("failure").Inc()
+			return
+		}
+		p.results.WithLabelValues("success").Inc()
+		p.lastSuccess.SetToCurrentTime()
+	}()
+
+	mfs, err := p.gatherer.Gather()
+	if err != nil {
+		if len(mfs) == 0 {
+			return err
+		}
+		prol.Warnf("some metrics could not be gathered: %s", err)
+	}
+
+	return p.push(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return mfs, nil
+	}))
+}
+
+// lastPush returns the outcome of the last push.
+func (p *pusher) lastPush() pushResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.last
+}
+
+// Delete removes the metrics group of this agent from the push gateway.
+func (p *pusher) Delete() error {
+	if p.dryRun {
+		prol.Infoln("dry run, not deleting metrics from push gateway")
+		return nil
+	}
+	pusher, err := p.newPusher(prometheus.NewRegistry())
+	if err != nil {
+		return err
+	}
+	return pusher.Client(p.client).Delete()
+}
+
+func (p *pusher) push(g prometheus.Gatherer) error {
+	if p.dryRun {
+		mfs, err := g.Gather()
+		if err != nil {
+			return err
+		}
+		n := 0
+		for _, mf := range mfs {
+			n += len(mf.Metric)
+		}
+		prol.Infof("dry run, not pushing %d metric families, %d series", len(mfs), n)
+		return nil
+	}
+	pusher, err := p.newPusher(g)
+	if err != nil {
+		return err
+	}
+	return pusher.Client(p.client).Push()
+}
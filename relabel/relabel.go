@@ -0,0 +1,166 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+// Package relabel filters metrics and rewrites their labels with
+// Prometheus-style relabel rules.
+package relabel
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/bizflycloud/bizfly-agent/config"
+)
+
+// nameLabel is the label holding the metric name in relabel rules.
+const nameLabel = "__name__"
+
+// rule is a compiled config.RelabelRule.
+type rule struct {
+	action       string
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	targetLabel  string
+	replacement  string
+	modulus      uint64
+}
+
+// Relabeler applies relabel rules and static labels to metrics. A nil
+// Relabeler keeps every metric unchanged.
+type Relabeler struct {
+	rules        []rule
+	staticLabels map[string]string
+}
+
+// New compiles cfg. It returns nil if cfg has no rules and no static labels.
+func New(cfg config.Relabel) (*Relabeler, error) {
+	if len(cfg.Rules) == 0 && len(cfg.StaticLabels) == 0 {
+		return nil, nil
+	}
+	r := &Relabeler{staticLabels: cfg.StaticLabels}
+	for i, c := range cfg.Rules {
+		ru := rule{
+			action:       c.Action,
+			sourceLabels: c.SourceLabels,
+			separator:    c.Separator,
+			targetLabel:  c.TargetLabel,
+			replacement:  c.Replacement,
+			modulus:      c.Modulus,
+		}
+		expr := c.Regex
+		if expr == "" {
+			expr = "(.*)"
+		}
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel rule %d: %s", i, err)
+		}
+		ru.regex = re
+		if ru.separator == "" {
+			ru.separator = ";"
+		}
+		if ru.replacement == "" {
+			ru.replacement = "$1"
+		}
+		if len(ru.sourceLabels) == 0 && (ru.action == config.RelabelKeep || ru.action == config.RelabelDrop) {
+			ru.sourceLabels = []string{nameLabel}
+		}
+		r.rules = append(r.rules, ru)
+	}
+	return r, nil
+}
+
+// Process applies the rules to the metric name with labels. It returns the
+// new labels, sorted by name, and false if the metric is dropped.
+func (r *Relabeler) Process(name string, labels []*dto.LabelPair) ([]*dto.LabelPair, bool) {
+	if r == nil {
+		return labels, true
+	}
+	ls := make(map[string]string, len(labels)+1)
+	for _, l := range labels {
+		ls[l.GetName()] = l.GetValue()
+	}
+	ls[nameLabel] = name
+
+	for _, ru := range r.rules {
+		if !ru.apply(ls) {
+			return nil, false
+		}
+	}
+	for k, v := range r.staticLabels {
+		if _, ok := ls[k]; !ok {
+			ls[k] = v
+		}
+	}
+
+	delete(ls, nameLabel)
+	out := make([]*dto.LabelPair, 0, len(ls))
+	for k, v := range ls {
+		if v == "" {
+			continue
+		}
+		k, v := k, v
+		out = append(out, &dto.LabelPair{Name: &k, Value: &v})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].GetName() < out[j].GetName() })
+	return out, true
+}
+
+// apply applies ru to ls and reports whether the metric is kept.
+func (ru rule) apply(ls map[string]string) bool {
+	values := make([]string, 0, len(ru.sourceLabels))
+	for _, l := range ru.sourceLabels {
+		values = append(values, ls[l])
+	}
+	val := strings.Join(values, ru.separator)
+
+	switch ru.action {
+	case config.RelabelKeep:
+		return ru.regex.MatchString(val)
+	case config.RelabelDrop:
+		return !ru.regex.MatchString(val)
+	case config.RelabelReplace:
+		m := ru.regex.FindStringSubmatchIndex(val)
+		if m == nil {
+			return true
+		}
+		ls[ru.targetLabel] = string(ru.regex.ExpandString(nil, ru.replacement, val, m))
+	case config.RelabelHashMod:
+		sum := md5.Sum([]byte(val))
+		ls[ru.targetLabel] = fmt.Sprint(binary.BigEndian.Uint64(sum[8:]) % ru.modulus)
+	case config.RelabelLabelDrop:
+		for k := range ls {
+			if k != nameLabel && ru.regex.MatchString(k) {
+				delete(ls, k)
+			}
+		}
+	case config.RelabelLabelKeep:
+		for k := range ls {
+			if k != nameLabel && !ru.regex.MatchString(k) {
+				delete(ls, k)
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,232 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package relabel
+
+import (
+	"reflect"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/bizflycloud/bizfly-agent/config"
+)
+
+func labelPairs(ls map[string]string) []*dto.LabelPair {
+	var out []*dto.LabelPair
+	for k, v := range ls {
+		k, v := k, v
+		out = append(out, &dto.LabelPair{Name: &k, Value: &v})
+	}
+	return out
+}
+
+func labelMap(ls []*dto.LabelPair) map[string]string {
+	out := map[string]string{}
+	for _, l := range ls {
+		out[l.GetName()] = l.GetValue()
+	}
+	return out
+}
+
+func TestProcess(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    config.Relabel
+		metric string
+		labels map[string]string
+		want   map[string]string
+		// dropped is set if the metric is dropped.
+		dropped bool
+	}{
+		{
+			name:   "keep defaults to the metric name",
+			cfg:    config.Relabel{Rules: []config.RelabelRule{{Action: config.RelabelKeep, Regex: "node_cpu_.+"}}},
+			metric: "node_cpu_seconds_total",
+			labels: map[string]string{"cpu": "0"},
+			want:   map[string]string{"cpu": "0"},
+		},
+		{
+			name:    "keep drops other metrics",
+			cfg:     config.Relabel{Rules: []config.RelabelRule{{Action: config.RelabelKeep, Regex: "node_cpu_.+"}}},
+			metric:  "node_load1",
+			dropped: true,
+		},
+		{
+			name:    "drop defaults to the metric name",
+			cfg:     config.Relabel{Rules: []config.RelabelRule{{Action: config.RelabelDrop, Regex: "node_load.*"}}},
+			metric:  "node_load1",
+			dropped: true,
+		},
+		{
+			name: "drop by source labels",
+			cfg: config.Relabel{Rules: []config.RelabelRule{{
+				Action:       config.RelabelDrop,
+				SourceLabels: []string{"device", "fstype"},
+				Regex:        "vda1;tmpfs",
+			}}},
+			metric: "node_filesystem_avail_bytes",
+			labels: map[string]string{"device": "vda1", "fstype": "ext4"},
+			want:   map[string]string{"device": "vda1", "fstype": "ext4"},
+		},
+		{
+			name: "regex is anchored",
+			cfg:  config.Relabel{Rules: []config.RelabelRule{{Action: config.RelabelDrop, Regex: "node_load"}}},
+			// node_load would match node_load1 if it wasn't anchored.
+			metric: "node_load1",
+			want:   map[string]string{},
+		},
+		{
+			name: "replace with $1",
+			cfg: config.Relabel{Rules: []config.RelabelRule{{
+				Action:       config.RelabelReplace,
+				SourceLabels: []string{"device"},
+				Regex:        "/dev/(.+)",
+				TargetLabel:  "disk",
+			}}},
+			metric: "node_disk_read_bytes_total",
+			labels: map[string]string{"device": "/dev/vda"},
+			want:   map[string]string{"device": "/dev/vda", "disk": "vda"},
+		},
+		{
+			name: "replace with a template",
+			cfg: config.Relabel{Rules: []config.RelabelRule{{
+				Action:       config.RelabelReplace,
+				SourceLabels: []string{"device", "mountpoint"},
+				Separator:    "@",
+				Regex:        "(.+)@(.+)",
+				TargetLabel:  "volume",
+				Replacement:  "$2 on $1",
+			}}},
+			metric: "node_filesystem_size_bytes",
+			labels: map[string]string{"device": "vdb", "mountpoint": "/data"},
+			want:   map[string]string{"device": "vdb", "mountpoint": "/data", "volume": "/data on vdb"},
+		},
+		{
+			name: "replace leaves labels alone if regex doesn't match",
+			cfg: config.Relabel{Rules: []config.RelabelRule{{
+				Action:       config.RelabelReplace,
+				SourceLabels: []string{"device"},
+				Regex:        "/dev/(.+)",
+				TargetLabel:  "disk",
+			}}},
+			metric: "node_disk_read_bytes_total",
+			labels: map[string]string{"device": "vda"},
+			want:   map[string]string{"device": "vda"},
+		},
+		{
+			name: "replace with an empty value removes the label",
+			cfg: config.Relabel{Rules: []config.RelabelRule{{
+				Action:       config.RelabelReplace,
+				SourceLabels: []string{"missing"},
+				Regex:        "(.*)",
+				TargetLabel:  "device",
+			}}},
+			metric: "node_disk_read_bytes_total",
+			labels: map[string]string{"device": "vda"},
+			want:   map[string]string{},
+		},
+		{
+			name: "hashmod",
+			cfg: config.Relabel{Rules: []config.RelabelRule{{
+				Action:       config.RelabelHashMod,
+				SourceLabels: []string{"instance"},
+				TargetLabel:  "shard",
+				Modulus:      8,
+			}}},
+			metric: "up",
+			labels: map[string]string{"instance": "web-2"},
+			want:   map[string]string{"instance": "web-2", "shard": "3"},
+		},
+		{
+			name:   "labeldrop",
+			cfg:    config.Relabel{Rules: []config.RelabelRule{{Action: config.RelabelLabelDrop, Regex: "mode|cpu"}}},
+			metric: "node_cpu_seconds_total",
+			labels: map[string]string{"cpu": "0", "mode": "idle", "host": "vm"},
+			want:   map[string]string{"host": "vm"},
+		},
+		{
+			name:   "labelkeep keeps the metric name",
+			cfg:    config.Relabel{Rules: []config.RelabelRule{{Action: config.RelabelLabelKeep, Regex: "cpu"}, {Action: config.RelabelKeep, Regex: "node_cpu_.+"}}},
+			metric: "node_cpu_seconds_total",
+			labels: map[string]string{"cpu": "0", "mode": "idle"},
+			want:   map[string]string{"cpu": "0"},
+		},
+		{
+			name:   "static labels don't override existing labels",
+			cfg:    config.Relabel{StaticLabels: map[string]string{"env": "prod", "host": "static"}},
+			metric: "node_load1",
+			labels: map[string]string{"host": "vm"},
+			want:   map[string]string{"env": "prod", "host": "vm"},
+		},
+		{
+			name: "static labels are added after the rules",
+			cfg: config.Relabel{
+				Rules:        []config.RelabelRule{{Action: config.RelabelLabelDrop, Regex: "env"}},
+				StaticLabels: map[string]string{"env": "prod"},
+			},
+			metric: "node_load1",
+			labels: map[string]string{"env": "dev"},
+			want:   map[string]string{"env": "prod"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := r.Process(tt.metric, labelPairs(tt.labels))
+			if ok == tt.dropped {
+				t.Fatalf("Process() kept = %v, want %v", ok, !tt.dropped)
+			}
+			if tt.dropped {
+				return
+			}
+			if m := labelMap(got); !reflect.DeepEqual(m, tt.want) {
+				t.Errorf("Process() = %v, want %v", m, tt.want)
+			}
+			for i := 1; i < len(got); i++ {
+				if got[i-1].GetName() >= got[i].GetName() {
+					t.Errorf("Process() labels are not sorted: %v", labelMap(got))
+				}
+			}
+		})
+	}
+}
+
+func TestNilRelabeler(t *testing.T) {
+	r, err := New(config.Relabel{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != nil {
+		t.Fatalf("New() = %v, want nil without rules and static labels", r)
+	}
+	labels := labelPairs(map[string]string{"cpu": "0"})
+	got, ok := r.Process("node_cpu_seconds_total", labels)
+	if !ok || !reflect.DeepEqual(got, labels) {
+		t.Errorf("Process() = %v, %v, want the labels unchanged", got, ok)
+	}
+}
+
+func TestNewInvalidRegex(t *testing.T) {
+	_, err := New(config.Relabel{Rules: []config.RelabelRule{{Action: config.RelabelKeep, Regex: "("}}})
+	if err == nil {
+		t.Error("New() succeeded with an invalid regex")
+	}
+}
@@ -0,0 +1,154 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bizflycloud/bizfly-agent/identity"
+)
+
+// State is what the agent learns at runtime and keeps across restarts, so
+// that the configuration file can stay read-only.
+type State struct {
+	// AgentID is the ID given by the server when the agent registered.
+	AgentID      string    `json:"agent_id,omitempty"`
+	RegisteredAt time.Time `json:"registered_at"`
+	// Token describes the last auth token fetched, not the token itself.
+	Token *Token `json:"token,omitempty"`
+	// Identity is the identity of the agent last reported to the server.
+	Identity *Identity `json:"identity,omitempty"`
+	// ClonedFrom is the ID of the agent registered by the host this one was
+	// cloned from, reported when the agent registers again.
+	ClonedFrom string `json:"cloned_from,omitempty"`
+	// IgnoredAgentID is the agent ID older agents wrote to the configuration
+	// file, ignored because it belongs to the host this one was cloned from.
+	IgnoredAgentID string `json:"ignored_agent_id,omitempty"`
+}
+
+// Identity is the host and the names the agent is known by on the server.
+type Identity struct {
+	identity.Identity
+	Name     string `json:"name"`
+	Hostname string `json:"hostname"`
+}
+
+// Token is metadata of an auth token.
+type Token struct {
+	FetchedAt time.Time `json:"fetched_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Store persists State to a JSON file.
+type Store struct {
+	path string
+
+	mu    sync.Mutex
+	state State
+}
+
+// Open returns a Store persisting to path, loaded with the state saved there
+// if the file exists.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Path returns the file the state is persisted to.
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Get returns a copy of the current state.
+func (s *Store) Get() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.clone()
+}
+
+// Update applies f to the state and saves it. The state in memory is
+// changed even if it can't be saved, so that the agent keeps what it learned
+// until it stops.
+func (s *Store) Update(f func(st *State)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f(&s.state)
+	return s.write(&s.state)
+}
+
+// clone returns a deep copy of st.
+func (st State) clone() State {
+	if st.Token != nil {
+		t := *st.Token
+		st.Token = &t
+	}
+	if st.Identity != nil {
+		id := *st.Identity
+		st.Identity = &id
+	}
+	return st
+}
+
+// write saves st to a temporary file renamed over the state file, so that
+// the state file is always complete.
+func (s *Store) write(st *State) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".state-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,178 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+// Package status serves the health and the status of a running agent on a
+// local-only address, and reads them back for `bizfly-agent status`.
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	prol "github.com/prometheus/common/log"
+)
+
+// unixPrefix marks an address as the path of a unix socket.
+const unixPrefix = "unix:"
+
+// Report is the status of a running agent, served on /status.
+type Report struct {
+	Version    string    `json:"version"`
+	StartedAt  time.Time `json:"started_at"`
+	ConfigFile string    `json:"config_file"`
+	AgentID    string    `json:"agent_id"`
+	Ready      bool      `json:"ready"`
+	// NotReady is why the agent is not ready.
+	NotReady   string   `json:"not_ready,omitempty"`
+	Token      Token    `json:"token"`
+	Push       Push     `json:"push"`
+	Collectors []string `json:"collectors"`
+}
+
+// Token is the status of the auth token.
+type Token struct {
+	Valid     bool      `json:"valid"`
+	FetchedAt time.Time `json:"fetched_at"`
+	// ExpiresAt is zero if the expiry of the token is unknown.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Push is the status of pushes to the push gateway.
+type Push struct {
+	Enabled     bool      `json:"enabled"`
+	URL         string    `json:"url"`
+	LastAttempt time.Time `json:"last_attempt"`
+	LastSuccess time.Time `json:"last_success"`
+	// LastError is the error of the last push, empty if it succeeded.
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Server serves /healthz, /readyz and /status.
+type Server struct {
+	report func() *Report
+}
+
+// NewServer returns a Server serving the reports made by report.
+func NewServer(report func() *Report) *Server {
+	return &Server{report: report}
+}
+
+// Serve listens on address and serves until ctx is done. address is a
+// loopback host:port, or unix: followed by the path of a unix socket. It
+// returns once the listener is open.
+func (s *Server) Serve(ctx context.Context, address string) error {
+	l, err := listen(address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if rep := s.report(); !rep.Ready {
+			http.Error(w, rep.NotReady, http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(s.report()); err != nil {
+			prol.Errorf("failed to write status: %s", err)
+		}
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	}()
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			prol.Errorf("failed to serve status: %s", err)
+		}
+	}()
+	prol.Infof("serving status on %s", address)
+	return nil
+}
+
+// Fetch returns the status of the agent serving on address.
+func Fetch(address string) (*Report, error) {
+	network, addr := split(address)
+	c := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		},
+	}
+	// The host is ignored, requests are sent to address.
+	resp, err := c.Get("http://bizfly-agent/status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	var rep Report
+	if err := json.NewDecoder(resp.Body).Decode(&rep); err != nil {
+		return nil, fmt.Errorf("invalid status: %s", err)
+	}
+	return &rep, nil
+}
+
+// split returns the network and the address of address.
+func split(address string) (network, addr string) {
+	if strings.HasPrefix(address, unixPrefix) {
+		return "unix", strings.TrimPrefix(address, unixPrefix)
+	}
+	return "tcp", address
+}
+
+// listen opens a listener on address. The socket left by an agent that
+// didn't stop cleanly is removed first.
+func listen(address string) (net.Listener, error) {
+	network, addr := split(address)
+	if network == "unix" {
+		if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.Dial("unix", addr); err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("%s is in use by another agent", addr)
+			}
+			os.Remove(addr)
+		}
+		if err := os.MkdirAll(filepath.Dir(addr), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen(network, addr)
+}
@@ -0,0 +1,167 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bizflycloud/bizfly-agent/client"
+	"github.com/bizflycloud/bizfly-agent/collectors"
+	"github.com/bizflycloud/bizfly-agent/config"
+	"github.com/bizflycloud/bizfly-agent/status"
+)
+
+// statusReporter returns a function making the status report of the agent
+// served on status.address.
+func statusReporter(store *config.Store, httpClient *client.Client, nc *collectors.NodeCollector,
+	p *pusher) func() *status.Report {
+	startedAt := time.Now()
+	v := version
+	if v == "" {
+		v = "dev"
+	}
+	return func() *status.Report {
+		cfg := store.Get()
+		token := httpClient.TokenStatus()
+		last := p.lastPush()
+		r := &status.Report{
+			Version:    v,
+			StartedAt:  startedAt,
+			ConfigFile: cfg.File(),
+			AgentID:    cfg.Agent.ID,
+			Token: status.Token{
+				Valid:     token.Valid,
+				FetchedAt: token.FetchedAt,
+				ExpiresAt: token.ExpiresAt,
+			},
+			Push: status.Push{
+				Enabled:     cfg.PushGW.Enabled,
+				URL:         cfg.PushGW.URL,
+				LastAttempt: last.attempt,
+				LastSuccess: last.success,
+			},
+		}
+		if last.err != nil {
+			r.Push.LastError = last.err.Error()
+		}
+		for name := range nc.Collectors() {
+			r.Collectors = append(r.Collectors, name)
+		}
+		sort.Strings(r.Collectors)
+
+		switch {
+		case !r.Push.Enabled:
+			// The agent only registers to push.
+			r.Ready = true
+		case r.AgentID == "":
+			r.NotReady = "agent is not registered"
+		case !r.Token.Valid:
+			r.NotReady = "no valid auth token"
+		case r.Push.LastAttempt.IsZero():
+			r.NotReady = "no push made yet"
+		case r.Push.LastError != "":
+			r.NotReady = "last push failed"
+		default:
+			r.Ready = true
+		}
+		return r
+	}
+}
+
+// showStatus implements `bizfly-agent status`. It prints the status of the
+// running agent and returns the exit code, non-zero unless the agent is
+// ready.
+func showStatus() int {
+	address := config.DefaultStatusAddress
+	if cfg, err := loadConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s, trying %s\n", err, address)
+	} else if address = cfg.Status.Address; address == "" {
+		fmt.Fprintln(os.Stderr, "status.address is not set, the status of the agent is not served")
+		return 1
+	}
+
+	r, err := status.Fetch(address)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't get the status of the agent on %s, is it running? %s\n", address, err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	ready := "yes"
+	if !r.Ready {
+		ready = "no, " + r.NotReady
+	}
+	fmt.Fprintf(w, "Ready:\t%s\n", ready)
+	fmt.Fprintf(w, "Version:\t%s\n", r.Version)
+	fmt.Fprintf(w, "Started:\t%s\n", formatTime(r.StartedAt))
+	fmt.Fprintf(w, "Configuration:\t%s\n", r.ConfigFile)
+	fmt.Fprintf(w, "Agent ID:\t%s\n", orNone(r.AgentID))
+
+	token := "invalid"
+	if r.Token.Valid {
+		token = "valid"
+	}
+	fmt.Fprintf(w, "Token:\t%s, fetched %s, expires %s\n", token, formatTime(r.Token.FetchedAt), formatTime(r.Token.ExpiresAt))
+
+	if r.Push.Enabled {
+		fmt.Fprintf(w, "Push gateway:\t%s\n", r.Push.URL)
+		fmt.Fprintf(w, "Last push:\t%s\n", formatTime(r.Push.LastAttempt))
+		fmt.Fprintf(w, "Last successful push:\t%s\n", formatTime(r.Push.LastSuccess))
+		if r.Push.LastError != "" {
+			fmt.Fprintf(w, "Last push error:\t%s\n", r.Push.LastError)
+		}
+	} else {
+		fmt.Fprintln(w, "Push gateway:\tdisabled")
+	}
+
+	fmt.Fprintf(w, "Collectors:\t%d enabled\n", len(r.Collectors))
+	for _, c := range r.Collectors {
+		fmt.Fprintf(w, "\t%s\n", c)
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	if !r.Ready {
+		return 1
+	}
+	return 0
+}
+
+// formatTime formats t with how long ago, or in how long, it is.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	d := time.Since(t).Round(time.Second)
+	if d < 0 {
+		return fmt.Sprintf("%s (in %s)", t.Local().Format(time.RFC3339), -d)
+	}
+	return fmt.Sprintf("%s (%s ago)", t.Local().Format(time.RFC3339), d)
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
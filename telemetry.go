@@ -0,0 +1,51 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// registerSelfMetrics registers metrics about the agent process itself to
+// reg: its build, the Go runtime and the process. Metrics about pushes,
+// tokens and node_exporter collectors are reported by their own
+// components.
+func registerSelfMetrics(reg prometheus.Registerer) {
+	v, commit := version, gitCommit
+	if v == "" {
+		v = "dev"
+	}
+	buildInfo := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bizfly_agent_build_info",
+		Help: "A metric with a constant '1' value labeled by version, revision and Go version of the agent.",
+		ConstLabels: prometheus.Labels{
+			"version":   v,
+			"revision":  commit,
+			"goversion": runtime.Version(),
+		},
+	})
+	buildInfo.Set(1)
+
+	reg.MustRegister(
+		buildInfo,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
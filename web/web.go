@@ -0,0 +1,173 @@
+// This file is part of bizfly-agent
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+// Package web serves the metrics of the agent to be scraped by Prometheus.
+package web
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	prol "github.com/prometheus/common/log"
+
+	"github.com/bizflycloud/bizfly-agent/config"
+)
+
+// Server serves the metrics gathered by a prometheus.Gatherer on
+// web.listen-address. Basic auth credentials and TLS certificates are taken
+// from the current configuration, so they can be changed without a restart.
+type Server struct {
+	config  *config.Store
+	handler http.Handler
+
+	// mu guards the certificate loaded from web.tls-cert-file.
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certKey certKey
+}
+
+// certKey identifies the files a certificate was loaded from.
+type certKey struct {
+	certFile, keyFile   string
+	certMtime, keyMtime time.Time
+}
+
+// New returns a Server serving the metrics gathered by g.
+func New(cfg *config.Store, g prometheus.Gatherer) *Server {
+	return &Server{
+		config: cfg,
+		handler: promhttp.HandlerFor(g, promhttp.HandlerOpts{
+			ErrorLog:      prol.NewErrorLogger(),
+			ErrorHandling: promhttp.ContinueOnError,
+		}),
+	}
+}
+
+// Serve listens on web.listen-address and serves metrics until ctx is done.
+// It returns once the listener is open, and does nothing if no address is
+// set.
+func (s *Server) Serve(ctx context.Context) error {
+	cfg := s.config.Get().Web
+	if cfg.ListenAddress == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", cfg.ListenAddress)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(cfg.TelemetryPath, s.authenticate(s.handler))
+	if cfg.TelemetryPath != "/" {
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write([]byte(`<html><head><title>BizFly Metrics Agent</title></head><body>` +
+				`<h1>BizFly Metrics Agent</h1><p><a href="` + cfg.TelemetryPath + `">Metrics</a></p></body></html>`))
+		})
+	}
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig:         &tls.Config{GetCertificate: s.getCertificate},
+	}
+
+	s.config.OnChange(func(old, new *config.Configurations) {
+		if old.Web.ListenAddress != new.Web.ListenAddress || old.Web.TelemetryPath != new.Web.TelemetryPath ||
+			(old.Web.TLSCertFile == "") != (new.Web.TLSCertFile == "") {
+			prol.Warnln("changes to web.listen-address, web.telemetry-path and enabling TLS are applied on restart only")
+		}
+	})
+
+	go func() {
+		<-ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	}()
+	go func() {
+		var err error
+		if cfg.TLSCertFile != "" {
+			err = srv.ServeTLS(l, "", "")
+		} else {
+			err = srv.Serve(l)
+		}
+		if err != http.ErrServerClosed {
+			prol.Errorf("failed to serve metrics: %s", err)
+		}
+	}()
+	prol.Infof("serving metrics on %s%s", cfg.ListenAddress, cfg.TelemetryPath)
+	return nil
+}
+
+// authenticate checks the basic auth credentials of requests, if set.
+func (s *Server) authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.config.Get().Web
+		if cfg.BasicAuthUsername != "" {
+			user, pass, ok := r.BasicAuth()
+			if !ok ||
+				subtle.ConstantTimeCompare([]byte(user), []byte(cfg.BasicAuthUsername)) != 1 ||
+				subtle.ConstantTimeCompare([]byte(pass), []byte(cfg.BasicAuthPassword)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="bizfly-agent"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// getCertificate returns the certificate in web.tls-cert-file, loading it
+// again when the files change.
+func (s *Server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cfg := s.config.Get().Web
+	key := certKey{certFile: cfg.TLSCertFile, keyFile: cfg.TLSKeyFile}
+	if fi, err := os.Stat(cfg.TLSCertFile); err == nil {
+		key.certMtime = fi.ModTime()
+	}
+	if fi, err := os.Stat(cfg.TLSKeyFile); err == nil {
+		key.keyMtime = fi.ModTime()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cert != nil && s.certKey == key {
+		return s.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		if s.cert != nil {
+			prol.Errorf("failed to load TLS certificate, keep using the old one: %s", err)
+			return s.cert, nil
+		}
+		return nil, err
+	}
+	s.cert, s.certKey = &cert, key
+	return s.cert, nil
+}